@@ -0,0 +1,149 @@
+package materialized
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// stateColumns are the node columns recorded in NodeState
+var stateColumns = []string{"name", "path", "parent_id", "owner_id", "owner_type", "metadata"}
+
+// stateSelect selects the node state from the columns with the given prefix
+func stateSelect(prefix string) string {
+	columns := []string{"code", "tenant_id", "tenant_type"}
+	for _, column := range stateColumns {
+		columns = append(columns, prefix+column+" AS "+column)
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// AsOfQuery returns a query builder for the nodes of the tenant as they were at
+// t, reconstructed from the node history: a node has the state recorded by its
+// last history entry at or before t, or the state before its first entry after
+// t. Nodes without any history, e.g. created before history was enabled, are
+// read from the tree table. The rows carry the recorded properties only.
+//
+// Entries are ordered by the time they were written, with the ID breaking ties.
+// ULIDs alone only sort in write order within one process, while the entries of
+// a node are written under its row lock, so their times follow the commits.
+func (tq *TreeQuery) AsOfQuery(tx *gorm.DB, t time.Time, tenantID, tenantType string) *gorm.DB {
+	history := func() *gorm.DB {
+		return tq.scopedHistory(tx, tenantID, tenantType)
+	}
+
+	// ranked numbers the entries of each node matching the condition in order
+	ranked := func(order, condition string) *gorm.DB {
+		return history().
+			Select("*, ROW_NUMBER() OVER (PARTITION BY code ORDER BY "+order+") AS history_rank").
+			Where(condition, t)
+	}
+
+	// Nodes changed at or before t, in the state of their last change
+	latest := tx.Table("(?) AS latest_history", ranked("created_at DESC, id DESC", "created_at <= ?")).
+		Select(stateSelect("after_")).
+		Where("history_rank = 1").
+		Where("action != ?", HistoryDeleted)
+
+	// Nodes first changed after t, in the state before that change
+	earliest := tx.Table("(?) AS earliest_history", ranked("created_at, id", "created_at > ?")).
+		Select(stateSelect("before_")).
+		Where("history_rank = 1").
+		Where("action != ?", HistoryCreated).
+		Where("code NOT IN (?)", history().
+			Select("code").
+			Where("created_at <= ?", t))
+
+	// Nodes never changed while history was recorded
+	untracked := tq.scoped(tx, tenantID, tenantType).
+		Select(stateSelect("")).
+		Where("created_at <= ?", t).
+		Where("deleted_at IS NULL OR deleted_at > ?", t).
+		Where("code NOT IN (?)", history().Select("code"))
+
+	return tx.Unscoped().Table("(? UNION ALL ? UNION ALL ?) AS nodes_as_of", latest, earliest, untracked)
+}
+
+// GetNodeByCodeAsOf retrieves a node as it was at t, including nodes deleted since
+func (tq *TreeQuery) GetNodeByCodeAsOf(code Code, t time.Time, tenantID, tenantType string) (*TreeNode, error) {
+	if !tq.historyEnabled() {
+		return nil, ErrHistoryDisabled
+	}
+	if err := code.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid code: %w", err)
+	}
+
+	var nodes []*TreeNode
+	if err := tq.AsOfQuery(tq.db, t, tenantID, tenantType).
+		Where("code = ?", code).
+		Limit(1).
+		Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, ErrUnauthorized
+	}
+
+	return nodes[0], nil
+}
+
+// GetDescendantsAsOf retrieves the descendants the node at parentPath had at t,
+// in path order
+func (tq *TreeQuery) GetDescendantsAsOf(parentPath Path, t time.Time, tenantID, tenantType string) ([]*TreeNode, error) {
+	if !tq.historyEnabled() {
+		return nil, ErrHistoryDisabled
+	}
+
+	var descendants []*TreeNode
+	if err := tq.AsOfQuery(tq.db, t, tenantID, tenantType).
+		Where("path LIKE ? AND path != ?", parentPath.GetPathPrefix(), string(parentPath)).
+		Order("path").
+		Find(&descendants).Error; err != nil {
+		return nil, err
+	}
+
+	return descendants, nil
+}
+
+// GetAncestorsAsOf retrieves the nodes on nodePath at t, from the root down to
+// the node itself
+func (tq *TreeQuery) GetAncestorsAsOf(nodePath Path, t time.Time, tenantID, tenantType string) ([]*TreeNode, error) {
+	if !tq.historyEnabled() {
+		return nil, ErrHistoryDisabled
+	}
+	if nodePath.IsRoot() {
+		return []*TreeNode{}, nil
+	}
+
+	var ancestors []*TreeNode
+	if err := tq.AsOfQuery(tq.db, t, tenantID, tenantType).
+		Where("path IN (?)", ancestorPaths(nodePath, 0)).
+		Order("LENGTH(path), path").
+		Find(&ancestors).Error; err != nil {
+		return nil, err
+	}
+
+	return ancestors, nil
+}
+
+// GetChildrenByCodeAsOf retrieves the direct children a node had at t, in path order
+func (tq *TreeQuery) GetChildrenByCodeAsOf(code Code, t time.Time, tenantID, tenantType string) ([]*TreeNode, error) {
+	node, err := tq.GetNodeByCodeAsOf(code, t, tenantID, tenantType)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []*TreeNode
+	if err := tq.AsOfQuery(tq.db, t, tenantID, tenantType).
+		Where("parent_id = ?", node.Code).
+		Order("path").
+		Find(&children).Error; err != nil {
+		return nil, err
+	}
+
+	return children, nil
+}
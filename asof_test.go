@@ -0,0 +1,177 @@
+package materialized
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// tick returns the current time between two changes a few milliseconds apart
+func tick() time.Time {
+	time.Sleep(5 * time.Millisecond)
+	t := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	return t
+}
+
+func TestAsOfReconstructsChangedNodes(t *testing.T) {
+	tq := newHistoryTree(t)
+
+	beforeCreate := tick()
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+	node := mustCreate(t, tq, "node", a.Path, "t1", "org")
+
+	afterCreate := tick()
+	if err := tq.UpdateNode(node.Code, "t1", "org", map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+
+	afterRename := tick()
+	if err := tq.MoveNode(node.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	movedPath, err := b.Path.AppendNode(node.Code)
+	if err != nil {
+		t.Fatalf("moved path: %v", err)
+	}
+
+	afterMove := tick()
+	if err := tq.DeleteNode(movedPath, "t1", "org", false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	afterDelete := tick()
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		want   string
+		path   Path
+		parent Code
+	}{
+		{"before create", beforeCreate, "", "", ""},
+		{"after create", afterCreate, "node", node.Path, a.Code},
+		{"after rename", afterRename, "renamed", node.Path, a.Code},
+		{"after move", afterMove, "renamed", movedPath, b.Code},
+		{"after delete", afterDelete, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tq.GetNodeByCodeAsOf(node.Code, tt.at, "t1", "org")
+			if tt.want == "" {
+				if !errors.Is(err, ErrUnauthorized) {
+					t.Fatalf("got %v, %v, want ErrUnauthorized", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("as of: %v", err)
+			}
+			if got.Name != tt.want || got.Path != tt.path || got.ParentID == nil || *got.ParentID != tt.parent {
+				t.Fatalf("got %s at %s under %v, want %s at %s under %s", got.Name, got.Path, got.ParentID, tt.want, tt.path, tt.parent)
+			}
+		})
+	}
+
+	children, err := tq.GetChildrenByCodeAsOf(a.Code, afterRename, "t1", "org")
+	if err != nil {
+		t.Fatalf("children: %v", err)
+	}
+	if len(children) != 1 || children[0].Code != node.Code {
+		t.Fatalf("a had %d children after the rename, want the node", len(children))
+	}
+
+	descendants, err := tq.GetDescendantsAsOf(a.Path, afterMove, "t1", "org")
+	if err != nil {
+		t.Fatalf("descendants: %v", err)
+	}
+	if len(descendants) != 0 {
+		t.Fatalf("a had %d descendants after the move, want none", len(descendants))
+	}
+
+	ancestors, err := tq.GetAncestorsAsOf(movedPath, afterMove, "t1", "org")
+	if err != nil {
+		t.Fatalf("ancestors: %v", err)
+	}
+	if got := names(ancestors); got != "b,renamed" {
+		t.Fatalf("ancestors after the move = %s, want b,renamed", got)
+	}
+
+	// Other tenants do not see the node at any time
+	if _, err := tq.GetNodeByCodeAsOf(node.Code, afterRename, "t2", "org"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v from another tenant, want ErrUnauthorized", err)
+	}
+}
+
+func TestAsOfReadsUntrackedNodesFromTheTree(t *testing.T) {
+	tq := newHistoryTree(t)
+
+	// Nodes changed without history have no entries
+	untracked, err := NewTreeQuery(tq.db, DefaultTableConfig())
+	if err != nil {
+		t.Fatalf("new tree query: %v", err)
+	}
+
+	beforeCreate := tick()
+	node := mustCreate(t, untracked, "node", RootPath, "t1", "org")
+	afterCreate := tick()
+	if err := untracked.DeleteNode(node.Path, "t1", "org", false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	afterDelete := tick()
+
+	if _, err := tq.GetNodeByCodeAsOf(node.Code, beforeCreate, "t1", "org"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v before the create, want ErrUnauthorized", err)
+	}
+
+	got, err := tq.GetNodeByCodeAsOf(node.Code, afterCreate, "t1", "org")
+	if err != nil {
+		t.Fatalf("as of: %v", err)
+	}
+	if got.Name != "node" || got.Path != node.Path {
+		t.Fatalf("got %s at %s", got.Name, got.Path)
+	}
+
+	if _, err := tq.GetNodeByCodeAsOf(node.Code, afterDelete, "t1", "org"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v after the delete, want ErrUnauthorized", err)
+	}
+}
+
+func TestAsOfOrdersEntriesByTime(t *testing.T) {
+	tq := newHistoryTree(t)
+	node := mustCreate(t, tq, "node", RootPath, "t1", "org")
+
+	// Two writers in different processes may write entries whose IDs sort
+	// against their order in time
+	first := time.Now().Add(time.Second)
+	second := first.Add(time.Millisecond)
+	entries := []*NodeHistory{
+		{
+			ID: "01ZZZZZZZZZZZZZZZZZZZZZZZZ", TenantID: "t1", TenantType: "org", Code: node.Code,
+			Action: HistoryUpdated, CreatedAt: first,
+			Before: nodeState(node), After: &NodeState{Name: "first", Path: node.Path},
+		},
+		{
+			ID: "01AAAAAAAAAAAAAAAAAAAAAAAA", TenantID: "t1", TenantType: "org", Code: node.Code,
+			Action: HistoryUpdated, CreatedAt: second,
+			Before: &NodeState{Name: "first", Path: node.Path}, After: &NodeState{Name: "second", Path: node.Path},
+		},
+	}
+	if err := CrossTenant(tq.db).Table(tq.config.HistoryTableName).Create(&entries).Error; err != nil {
+		t.Fatalf("write history: %v", err)
+	}
+
+	for at, want := range map[time.Time]string{
+		first.Add(-time.Millisecond / 2): "node",
+		first.Add(time.Millisecond / 2):  "first",
+		second.Add(time.Millisecond):     "second",
+	} {
+		got, err := tq.GetNodeByCodeAsOf(node.Code, at, "t1", "org")
+		if err != nil {
+			t.Fatalf("as of: %v", err)
+		}
+		if got.Name != want {
+			t.Fatalf("got %s at %s, want %s", got.Name, at, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package materialized
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// pathsBetween returns the paths from a up to the lowest common ancestor of a
+// and b and down to b, in that order
+func pathsBetween(a, b Path) []Path {
+	ancestor := CommonAncestor(a, b)
+
+	paths := make([]Path, 0, Distance(a, b)+1)
+	for depth := a.Depth(); depth >= ancestor.Depth(); depth-- {
+		p, _ := a.GetAncestorAtDepth(depth)
+		paths = append(paths, p)
+	}
+	for depth := ancestor.Depth() + 1; depth <= b.Depth(); depth++ {
+		p, _ := b.GetAncestorAtDepth(depth)
+		paths = append(paths, p)
+	}
+
+	return paths
+}
+
+// GetPathBetweenQuery returns a query builder for the nodes on the chain
+// between two paths, through their lowest common ancestor
+func (tq *TreeQuery) GetPathBetweenQuery(tx *gorm.DB, pathA, pathB Path, tenantID, tenantType string) *gorm.DB {
+	return tq.scoped(tx, tenantID, tenantType).
+		Where("path IN (?)", pathsBetween(pathA, pathB))
+}
+
+// GetPathBetweenByCodeQuery returns a query builder for the nodes with codeA
+// and codeB and all their ancestors, the candidates for the chain between them.
+// The paths of both nodes are resolved in subqueries, so they are not read first.
+func (tq *TreeQuery) GetPathBetweenByCodeQuery(tx *gorm.DB, codeA, codeB Code, tenantID, tenantType string) *gorm.DB {
+	for _, code := range []Code{codeA, codeB} {
+		if err := code.Validate(); err != nil {
+			tx.AddError(fmt.Errorf("invalid code: %w", err))
+			return tx
+		}
+	}
+
+	pathA := tq.nodeColumnQuery(tx, "path", codeA, tenantID, tenantType)
+	pathB := tq.nodeColumnQuery(tx, "path", codeB, tenantID, tenantType)
+	descendants := PathSeparator + "%"
+
+	return tq.scoped(tx, tenantID, tenantType).
+		Where("path = ? OR path = (?) OR path = (?) OR (?) LIKE CONCAT(path, ?) OR (?) LIKE CONCAT(path, ?)",
+			string(RootPath), pathA, pathB, pathA, descendants, pathB, descendants)
+}
+
+// GetPathBetween retrieves the chain of nodes from the node with codeA up to the
+// lowest common ancestor of both nodes and down to the node with codeB, in a
+// single query. Both endpoints are included; the root node is included only
+// when it is the common ancestor and exists.
+func (tq *TreeQuery) GetPathBetween(codeA, codeB Code, tenantID, tenantType string) ([]*TreeNode, error) {
+	var nodes []*TreeNode
+	if err := tq.GetPathBetweenByCodeQuery(tq.db, codeA, codeB, tenantID, tenantType).
+		Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	var a, b *TreeNode
+	byPath := make(map[Path]*TreeNode, len(nodes))
+	for _, node := range nodes {
+		byPath[node.Path] = node
+		if node.Code == codeA {
+			a = node
+		}
+		if node.Code == codeB {
+			b = node
+		}
+	}
+	if a == nil || b == nil {
+		return nil, ErrUnauthorized
+	}
+
+	paths := pathsBetween(a.Path, b.Path)
+	chain := make([]*TreeNode, 0, len(paths))
+	for _, p := range paths {
+		node, ok := byPath[p]
+		if !ok {
+			if p.IsRoot() {
+				continue
+			}
+			return nil, fmt.Errorf("node %s on path between %s and %s not found", p, codeA, codeB)
+		}
+		chain = append(chain, node)
+	}
+
+	return chain, nil
+}
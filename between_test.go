@@ -0,0 +1,114 @@
+package materialized
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCommonAncestorAndDistance(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     Path
+		ancestor Path
+		distance int
+	}{
+		{"same node", "/a/b", "/a/b", "/a/b", 0},
+		{"parent and child", "/a", "/a/b", "/a", 1},
+		{"ancestor and descendant", "/a/b/c/d", "/a/b", "/a/b", 2},
+		{"siblings", "/a/b", "/a/c", "/a", 2},
+		{"different branches", "/a/b/x", "/a/c/y", "/a", 4},
+		{"different root-level nodes", "/a/b", "/c", "/", 3},
+		{"root and node", "/", "/a/b", "/", 2},
+		{"shared prefix in a code", "/ab/c", "/a/c", "/", 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommonAncestor(tt.a, tt.b); got != tt.ancestor {
+				t.Fatalf("CommonAncestor = %s, want %s", got, tt.ancestor)
+			}
+			if got := CommonAncestor(tt.b, tt.a); got != tt.ancestor {
+				t.Fatalf("CommonAncestor reversed = %s, want %s", got, tt.ancestor)
+			}
+			if got := Distance(tt.a, tt.b); got != tt.distance {
+				t.Fatalf("Distance = %d, want %d", got, tt.distance)
+			}
+			if got := Distance(tt.b, tt.a); got != tt.distance {
+				t.Fatalf("Distance reversed = %d, want %d", got, tt.distance)
+			}
+		})
+	}
+
+	if got := CommonAncestor(); got != RootPath {
+		t.Fatalf("CommonAncestor() = %s, want the root", got)
+	}
+	if got := CommonAncestor("/a/b/c", "/a/b/d", "/a/e"); got != "/a" {
+		t.Fatalf("CommonAncestor of three = %s, want /a", got)
+	}
+}
+
+func TestGetPathBetween(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", a.Path, "t1", "org")
+	c := mustCreate(t, tq, "c", a.Path, "t1", "org")
+	x := mustCreate(t, tq, "x", b.Path, "t1", "org")
+	y := mustCreate(t, tq, "y", c.Path, "t1", "org")
+	z := mustCreate(t, tq, "z", RootPath, "t1", "org")
+	mustCreate(t, tq, "other", RootPath, "t2", "org")
+
+	tests := []struct {
+		name string
+		a, b *TreeNode
+		want string
+	}{
+		{"same node", b, b, "b"},
+		{"ancestor to descendant", a, x, "a,b,x"},
+		{"descendant to ancestor", x, a, "x,b,a"},
+		{"siblings", b, c, "b,a,c"},
+		{"different branches", x, y, "x,b,a,c,y"},
+		{"different root-level trees without a root node", x, z, "x,b,a,z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := countQueries(t, tq.db)
+			defer tq.db.Callback().Query().Remove("test:count")
+
+			chain, err := tq.GetPathBetween(tt.a.Code, tt.b.Code, "t1", "org")
+			if err != nil {
+				t.Fatalf("path between: %v", err)
+			}
+			if got := names(chain); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+			if *queries != 1 {
+				t.Fatalf("ran %d queries, want 1", *queries)
+			}
+		})
+	}
+
+	// The root node is the common ancestor of root-level trees once it exists
+	if _, err := tq.GetRootNode("t1", "org"); err != nil {
+		t.Fatalf("root: %v", err)
+	}
+	chain, err := tq.GetPathBetween(x.Code, z.Code, "t1", "org")
+	if err != nil {
+		t.Fatalf("path between: %v", err)
+	}
+	if len(chain) != 5 || !chain[3].Path.IsRoot() {
+		t.Fatalf("got %s, want x,b,a,root,z", names(chain))
+	}
+}
+
+func TestGetPathBetweenMissingNode(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	other := mustCreate(t, tq, "other", RootPath, "t2", "org")
+
+	if _, err := tq.GetPathBetween(a.Code, other.Code, "t1", "org"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v for another tenant's node, want ErrUnauthorized", err)
+	}
+	if _, err := tq.GetPathBetween(a.Code, "invalid", "t1", "org"); err == nil {
+		t.Fatal("got no error for an invalid code")
+	}
+}
@@ -0,0 +1,135 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+type requestKey struct{}
+
+// traceContext counts the statements run with and without the request value in
+// their context
+func traceContext(t *testing.T, db *gorm.DB) (with, without *int) {
+	t.Helper()
+
+	with, without = new(int), new(int)
+	trace := func(tx *gorm.DB) {
+		if tx.DryRun {
+			return
+		}
+		if tx.Statement.Context.Value(requestKey{}) == "request" {
+			*with++
+		} else {
+			*without++
+		}
+	}
+
+	callbacks := db.Callback()
+	for _, err := range []error{
+		callbacks.Create().Before("gorm:create").Register("test:context", trace),
+		callbacks.Query().Before("gorm:query").Register("test:context", trace),
+		callbacks.Update().Before("gorm:update").Register("test:context", trace),
+		callbacks.Delete().Before("gorm:delete").Register("test:context", trace),
+		callbacks.Row().Before("gorm:row").Register("test:context", trace),
+		callbacks.Raw().Before("gorm:raw").Register("test:context", trace),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		callbacks.Create().Remove("test:context")
+		callbacks.Query().Remove("test:context")
+		callbacks.Update().Remove("test:context")
+		callbacks.Delete().Remove("test:context")
+		callbacks.Row().Remove("test:context")
+		callbacks.Raw().Remove("test:context")
+	})
+
+	return with, without
+}
+
+func TestWithContextReachesEveryStatement(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	with, without := traceContext(t, tq.db)
+
+	ctx := tq.WithContext(context.WithValue(context.Background(), requestKey{}, "request"))
+	a, err := ctx.CreateNode("a", RootPath, "t1", "org", "owner", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ctx.CreateNode("b", RootPath, "t1", "org", "owner", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := ctx.CreateNode("child", a.Path, "t1", "org", "owner", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.UpdateNode(child.Code, "t1", "org", map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.MoveNode(a.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.GetPathBetween(child.Code, b.Code, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ctx.GetDescendants(b.Path, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := ctx.GetNodeByCode(a.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.DeleteNode(moved.Path, "t1", "org", true); err != nil {
+		t.Fatal(err)
+	}
+
+	if *with == 0 || *without != 0 {
+		t.Fatalf("%d statements ran with the context, %d without", *with, *without)
+	}
+
+	// The TreeQuery it was derived from keeps its own context
+	if _, err := tq.GetNodeByCode(b.Code, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	if *without != 1 {
+		t.Fatalf("%d statements of the original TreeQuery ran without the context, want 1", *without)
+	}
+}
+
+func TestWithContextCancelled(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := tq.WithContext(ctx)
+
+	if _, err := cancelled.GetNodeByCode(a.Code, "t1", "org"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("get: got %v, want context.Canceled", err)
+	}
+	if _, err := cancelled.CreateNode("c", RootPath, "t1", "org", "owner", "user"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("create: got %v, want context.Canceled", err)
+	}
+	if err := cancelled.MoveNode(a.Path, b.Path, "t1", "org"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("move: got %v, want context.Canceled", err)
+	}
+	if err := cancelled.DeleteNode(b.Path, "t1", "org", true); !errors.Is(err, context.Canceled) {
+		t.Fatalf("delete: got %v, want context.Canceled", err)
+	}
+
+	// Nothing changed
+	nodes, err := tq.GetNodesByDepth(1, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(nodes); got != "a,b" {
+		t.Fatalf("got %s after cancelled mutations, want a,b", got)
+	}
+}
@@ -0,0 +1,317 @@
+package materialized
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// idempotencyIndex is the unique index on the tenant and idempotency key
+const idempotencyIndex = "idx_idempotency_key"
+
+var (
+	// ErrCodeExists is returned when a supplied code is already used by a node
+	ErrCodeExists = errors.New("node code already exists")
+
+	// ErrIdempotencyMismatch is returned when an idempotency key is replayed with
+	// arguments other than those of the create that first used it
+	ErrIdempotencyMismatch = errors.New("idempotency key reused with different arguments")
+)
+
+// CreateOption configures CreateNode
+type CreateOption func(*createOptions)
+
+type createOptions struct {
+	code           Code
+	idempotencyKey string
+}
+
+// AssignCode creates the node with the given code instead of a generated one.
+// The code must be a valid ULID that no other node uses.
+func AssignCode(code Code) CreateOption {
+	return func(o *createOptions) {
+		o.code = code
+	}
+}
+
+// IdempotencyKey makes the create idempotent: when a node of the tenant was
+// already created with key, that node is returned instead of creating another,
+// so retried requests do not create duplicates. A replay must carry the same
+// name, parent path, owner and assigned code as the first request, otherwise it
+// fails with ErrIdempotencyMismatch. Keys stay taken after the node is deleted,
+// a replay then returns the deleted node.
+func IdempotencyKey(key string) CreateOption {
+	return func(o *createOptions) {
+		o.idempotencyKey = key
+	}
+}
+
+func newCreateOptions(opts []CreateOption) *createOptions {
+	o := &createOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// fingerprint hashes the arguments of a create, stored with its idempotency key
+func (o *createOptions) fingerprint(name string, parentPath Path, ownerID, ownerType string) (string, error) {
+	data, err := json.Marshal(struct {
+		Name       string
+		ParentPath Path
+		OwnerID    string
+		OwnerType  string
+		Code       Code
+	}{name, parentPath, ownerID, ownerType, o.code})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// checkReplay fails with ErrIdempotencyMismatch if the node created with the
+// idempotency key was created with other arguments. Nodes created before
+// fingerprints were stored are accepted.
+func (o *createOptions) checkReplay(existing *TreeNode, name string, parentPath Path, ownerID, ownerType string) error {
+	if existing.IdempotencyHash == nil {
+		return nil
+	}
+
+	hash, err := o.fingerprint(name, parentPath, ownerID, ownerType)
+	if err != nil {
+		return err
+	}
+	if hash != *existing.IdempotencyHash {
+		return fmt.Errorf("%w: %s", ErrIdempotencyMismatch, o.idempotencyKey)
+	}
+
+	return nil
+}
+
+// GetNodeByIdempotencyKeyQuery returns a query builder for the node created with
+// an idempotency key. Deleted nodes are included, as they keep their keys in the
+// unique index.
+func (tq *TreeQuery) GetNodeByIdempotencyKeyQuery(tx *gorm.DB, key string, tenantID, tenantType string) *gorm.DB {
+	return tq.scoped(tx, tenantID, tenantType).
+		Unscoped().
+		Where("idempotency_key = ?", key)
+}
+
+// GetNodeByIdempotencyKey retrieves the node created with an idempotency key,
+// which may have been deleted since
+func (tq *TreeQuery) GetNodeByIdempotencyKey(key string, tenantID, tenantType string) (*TreeNode, error) {
+	var node TreeNode
+	result := tq.GetNodeByIdempotencyKeyQuery(tq.db, key, tenantID, tenantType).First(&node)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUnauthorized
+		}
+		return nil, result.Error
+	}
+
+	return &node, nil
+}
+
+// migrateIdempotencyIndex creates the unique index on the tenant and idempotency
+// key. It is declared here rather than in struct tags, which would put the
+// tenant columns of every model embedding TenantFields into a unique index.
+func (tq *TreeQuery) migrateIdempotencyIndex() error {
+	db := CrossTenant(tq.db)
+	if db.Migrator().HasIndex(&TreeNode{}, idempotencyIndex) {
+		return nil
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&TreeNode{}); err != nil {
+		return err
+	}
+
+	return db.Exec("CREATE UNIQUE INDEX ? ON ? (?)",
+		clause.Column{Name: idempotencyIndex},
+		clause.Table{Name: stmt.Schema.Table},
+		[]clause.Column{{Name: "tenant_id"}, {Name: "tenant_type"}, {Name: "idempotency_key"}},
+	).Error
+}
+
+// checkCodesAvailable fails with ErrCodeExists if any of the codes is in use.
+// Codes are unique across tenants and deleted nodes keep theirs, so the check
+// covers the whole table.
+func (tq *TreeQuery) checkCodesAvailable(codes []Code) error {
+	if len(codes) == 0 {
+		return nil
+	}
+
+	var taken []Code
+	if err := CrossTenant(tq.db).Table(tq.config.TableName).
+		Where("code IN (?)", codes).
+		Limit(1).
+		Pluck("code", &taken).Error; err != nil {
+		return err
+	}
+
+	if len(taken) > 0 {
+		return fmt.Errorf("%w: %s", ErrCodeExists, taken[0])
+	}
+
+	return nil
+}
+
+// BatchNode describes a node created by ImportNodes
+type BatchNode struct {
+	// Code is the code of the new node, generated when empty
+	Code Code
+
+	Name       string
+	ParentPath Path
+	OwnerID    string
+	OwnerType  string
+}
+
+// ImportNodes creates multiple nodes in a single transaction, keeping the codes
+// given in the batch so imported nodes preserve their identities. Nodes may be
+// created under nodes created earlier in the same batch.
+func (tq *TreeQuery) ImportNodes(nodes []BatchNode, tenantID, tenantType string) ([]*TreeNode, error) {
+	var createdNodes []*TreeNode
+
+	err := tq.transaction(func(tq *TreeQuery) error {
+		batchNodes := make([]*TreeNode, 0, len(nodes))
+
+		// Assigned codes are validated and checked for collisions up front
+		assigned := make(map[Code]bool)
+		assignedCodes := make([]Code, 0, len(nodes))
+		for _, nodeInfo := range nodes {
+			if nodeInfo.Code == "" {
+				continue
+			}
+			if err := nodeInfo.Code.Validate(); err != nil {
+				return fmt.Errorf("invalid code %s: %w", nodeInfo.Code, err)
+			}
+			if assigned[nodeInfo.Code] {
+				return fmt.Errorf("%w: %s is assigned twice", ErrCodeExists, nodeInfo.Code)
+			}
+			assigned[nodeInfo.Code] = true
+			assignedCodes = append(assignedCodes, nodeInfo.Code)
+		}
+
+		if err := tq.checkCodesAvailable(assignedCodes); err != nil {
+			return err
+		}
+
+		// Collect unique parent paths
+		parentPathMap := make(map[Path]*Code)
+		seenParentPaths := make(map[Path]bool)
+		uniqueParentPaths := make([]Path, 0)
+		for _, nodeInfo := range nodes {
+			if !nodeInfo.ParentPath.IsRoot() && !seenParentPaths[nodeInfo.ParentPath] {
+				seenParentPaths[nodeInfo.ParentPath] = true
+				uniqueParentPaths = append(uniqueParentPaths, nodeInfo.ParentPath)
+			}
+		}
+
+		for _, parentPath := range uniqueParentPaths {
+			if err := tq.checkLocks(parentPath, tenantID, tenantType, false); err != nil {
+				return err
+			}
+		}
+
+		// Fetch all parent nodes in a single query
+		if len(uniqueParentPaths) > 0 {
+			var parentNodes []*TreeNode
+			result := tq.scoped(tq.db, tenantID, tenantType).
+				Where("path IN (?)", uniqueParentPaths).
+				Find(&parentNodes)
+
+			if result.Error != nil {
+				return result.Error
+			}
+
+			// Build parent path to ID map
+			for _, parent := range parentNodes {
+				parentPathMap[parent.Path] = &parent.Code
+			}
+		}
+
+		// Create nodes using the parent path map
+		for _, nodeInfo := range nodes {
+			var parentID *Code
+			if !nodeInfo.ParentPath.IsRoot() {
+				var exists bool
+				parentID, exists = parentPathMap[nodeInfo.ParentPath]
+				if !exists {
+					return fmt.Errorf("parent node not found for path %s", nodeInfo.ParentPath)
+				}
+			}
+
+			newNodeID := nodeInfo.Code
+			if newNodeID == "" {
+				newNodeID = tq.newID()
+			}
+			nodePath, err := nodeInfo.ParentPath.AppendNode(newNodeID)
+			if err != nil {
+				return err
+			}
+
+			node := &TreeNode{
+				Code:     newNodeID,
+				Path:     nodePath,
+				Name:     nodeInfo.Name,
+				ParentID: parentID,
+				Tenant:   TenantFields{tenantID, tenantType},
+				Owner:    OwnerFields{nodeInfo.OwnerID, nodeInfo.OwnerType},
+			}
+
+			// Later nodes of the batch may be created under this one
+			parentPathMap[node.Path] = &node.Code
+
+			batchNodes = append(batchNodes, node)
+		}
+
+		events := make([]*CreateEvent, len(batchNodes))
+		for i, node := range batchNodes {
+			events[i] = &CreateEvent{Tenant: Tenant{tenantID, tenantType}, Node: node}
+			if err := runHooks(tq.db, tq.hooks.registered().beforeCreate, events[i]); err != nil {
+				return err
+			}
+		}
+
+		if err := tq.db.Table(tq.config.TableName).CreateInBatches(batchNodes, 100).Error; err != nil {
+			return err
+		}
+
+		history := make([]*NodeHistory, len(batchNodes))
+		outbox := make([]*OutboxEvent, len(batchNodes))
+		for i, node := range batchNodes {
+			history[i] = historyEntry(HistoryCreated, tenantID, tenantType, nil, node)
+			outbox[i] = nodeEvent(EventNodeCreated, node)
+		}
+		if err := tq.writeHistory(history...); err != nil {
+			return err
+		}
+		if err := tq.writeOutbox(outbox...); err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			if err := runHooks(tq.db, tq.hooks.registered().afterCreate, event); err != nil {
+				return err
+			}
+		}
+
+		createdNodes = batchNodes
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return createdNodes, nil
+}
@@ -0,0 +1,112 @@
+package materialized
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreateNodeIdempotencyReplay(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	parent := mustCreate(t, tq, "parent", RootPath, "t1", "org")
+	other := mustCreate(t, tq, "other", RootPath, "t1", "org")
+
+	create := func(name string, parentPath Path, ownerID string) (*TreeNode, error) {
+		return tq.CreateNode(name, parentPath, "t1", "org", ownerID, "user", IdempotencyKey("request-1"))
+	}
+
+	first, err := create("child", parent.Path, "owner")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	replay, err := create("child", parent.Path, "owner")
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if replay.Code != first.Code {
+		t.Fatalf("replay returned %s, want %s", replay.Code, first.Code)
+	}
+
+	// The node is compared with the original request, not its current state
+	if err := tq.UpdateNode(first.Code, "t1", "org", map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if _, err := create("child", parent.Path, "owner"); err != nil {
+		t.Fatalf("replay after rename: %v", err)
+	}
+
+	mismatches := []struct {
+		name       string
+		nodeName   string
+		parentPath Path
+		ownerID    string
+	}{
+		{"name", "renamed", parent.Path, "owner"},
+		{"parent", "child", other.Path, "owner"},
+		{"owner", "child", parent.Path, "someone-else"},
+	}
+	for _, m := range mismatches {
+		t.Run(m.name, func(t *testing.T) {
+			if _, err := create(m.nodeName, m.parentPath, m.ownerID); !errors.Is(err, ErrIdempotencyMismatch) {
+				t.Fatalf("got %v, want ErrIdempotencyMismatch", err)
+			}
+		})
+	}
+
+	// Another tenant has its own keys
+	if _, err := tq.CreateNode("child", RootPath, "t2", "org", "owner", "user", IdempotencyKey("request-1")); err != nil {
+		t.Fatalf("create in another tenant: %v", err)
+	}
+}
+
+func TestCreateNodeIdempotencyReplayAfterDelete(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	first, err := tq.CreateNode("child", RootPath, "t1", "org", "owner", "user", IdempotencyKey("request-1"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := tq.DeleteNode(first.Path, "t1", "org", false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	replay, err := tq.CreateNode("child", RootPath, "t1", "org", "owner", "user", IdempotencyKey("request-1"))
+	if err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if replay.Code != first.Code || !replay.DeletedAt.Valid {
+		t.Fatalf("replay returned %s (deleted %v), want deleted %s", replay.Code, replay.DeletedAt.Valid, first.Code)
+	}
+
+	if _, err := tq.CreateNode("renamed", RootPath, "t1", "org", "owner", "user", IdempotencyKey("request-1")); !errors.Is(err, ErrIdempotencyMismatch) {
+		t.Fatalf("got %v, want ErrIdempotencyMismatch", err)
+	}
+}
+
+func TestIdempotencyKeyIndex(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	var columns []string
+	if err := CrossTenant(tq.db).Raw("SELECT name FROM pragma_index_info('idx_idempotency_key') ORDER BY seqno").
+		Scan(&columns).Error; err != nil {
+		t.Fatalf("index info: %v", err)
+	}
+	if want := []string{"tenant_id", "tenant_type", "idempotency_key"}; !equalStrings(columns, want) {
+		t.Fatalf("index columns = %v, want %v", columns, want)
+	}
+
+	// Other models embedding TenantFields get no unique index on the tenant
+	type account struct {
+		ID     uint
+		Tenant TenantFields `gorm:"embedded"`
+	}
+	db := newTestDB(t)
+	if err := db.AutoMigrate(&account{}); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Create(&account{Tenant: TenantFields{"t1", "org"}}).Error; err != nil {
+			t.Fatalf("create account %d: %v", i, err)
+		}
+	}
+}
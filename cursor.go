@@ -0,0 +1,182 @@
+package materialized
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+	// or was issued for a different tenant or query
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// cursorToken is the decoded form of a pagination cursor.
+// It carries the sort key of the last row of a page and a fingerprint of the
+// tenant and query that produced it.
+type cursorToken struct {
+	Shape  string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
+// shape returns a fingerprint of the tenant, filters and order of the query.
+// Cursors are only accepted by queries with the same shape.
+func (o *findOptions) shape(tenant Tenant) string {
+	data, _ := json.Marshal(struct {
+		Tenant           Tenant
+		Subtree          *Path
+		Parent           *Code
+		Depth            *int
+		MaxRelativeDepth *int
+		Owner            *OwnerFields
+		NameLike         string
+		NameQuery        *string
+		MatchMode        MatchMode
+		IgnoreCase       bool
+		MinDepth         *int
+		MaxDepth         *int
+		CreatedFrom      time.Time
+		CreatedTo        time.Time
+		UpdatedFrom      time.Time
+		UpdatedTo        time.Time
+		Metadata         map[string]string
+		Order            Order
+		Desc             bool
+	}{
+		tenant, o.subtree, o.parent, o.depth, o.maxRelativeDepth, o.owner, o.nameLike,
+		o.nameQuery, o.matchMode, o.ignoreCase, o.minDepth, o.maxDepth,
+		o.createdFrom, o.createdTo, o.updatedFrom, o.updatedTo, o.metadata,
+		o.order, o.desc,
+	})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:12])
+}
+
+// encodeCursor returns an opaque cursor for the sort key values
+func encodeCursor(shape string, values []interface{}) (string, error) {
+	data, err := json.Marshal(cursorToken{Shape: shape, Values: values})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns the sort key values of a cursor after checking that it
+// was issued for a query with the same shape and keys
+func decodeCursor(cursor, shape string, keys []string) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var token cursorToken
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&token); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if token.Shape != shape || len(token.Values) != len(keys) {
+		return nil, ErrInvalidCursor
+	}
+
+	for i, key := range keys {
+		switch v := token.Values[i].(type) {
+		case json.Number:
+			if key != "position" {
+				return nil, ErrInvalidCursor
+			}
+			n, err := v.Int64()
+			if err != nil {
+				return nil, ErrInvalidCursor
+			}
+			token.Values[i] = n
+		case string:
+			if key == "position" {
+				return nil, ErrInvalidCursor
+			}
+		default:
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	return token.Values, nil
+}
+
+// sortValues returns the node's values for the given keyset columns
+func (n *TreeNode) sortValues(keys []string) []interface{} {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		switch key {
+		case "path":
+			values[i] = string(n.Path)
+		case "name":
+			values[i] = n.Name
+		case "code":
+			values[i] = string(n.Code)
+		case "position":
+			values[i] = n.Position
+		}
+	}
+
+	return values
+}
+
+// compareSortValues compares the sort values of two nodes key by key
+func compareSortValues(a, b []interface{}) int {
+	for i := range a {
+		switch x := a[i].(type) {
+		case int:
+			if y := b[i].(int); x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		case string:
+			if c := strings.Compare(x, b[i].(string)); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return 0
+}
+
+// keysetCondition builds a portable row comparison selecting the rows after values,
+// e.g. (a > ? OR (a = ? AND b > ?)) for keys (a, b)
+func keysetCondition(keys []string, values []interface{}, desc bool) clause.Expr {
+	op := ">"
+	if desc {
+		op = "<"
+	}
+
+	var (
+		clauses []string
+		args    []interface{}
+	)
+	for i := range keys {
+		parts := make([]string, 0, i+1)
+		for j := 0; j < i; j++ {
+			parts = append(parts, keys[j]+" = ?")
+			args = append(args, values[j])
+		}
+		parts = append(parts, keys[i]+" "+op+" ?")
+		args = append(args, values[i])
+
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+	}
+
+	return gorm.Expr("("+strings.Join(clauses, " OR ")+")", args...)
+}
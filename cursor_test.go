@@ -0,0 +1,191 @@
+package materialized
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// retoken decodes cursor, lets change edit its token and encodes it again
+func retoken(t *testing.T, cursor string, change func(*cursorToken)) string {
+	t.Helper()
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var token cursorToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		t.Fatal(err)
+	}
+	change(&token)
+	if data, err = json.Marshal(token); err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestCursorRejectedAcrossTenantsAndShapes(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	for _, name := range []string{"a", "b", "c"} {
+		mustCreate(t, tq, name, RootPath, "t1", "org")
+		mustCreate(t, tq, name, RootPath, "t2", "org")
+	}
+
+	ctx := context.Background()
+	t1 := Tenant{"t1", "org"}
+	first, err := tq.Find(ctx, t1, Limit(1), OrderBy(OrderName, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.NextCursor == "" {
+		t.Fatal("got no cursor")
+	}
+
+	tests := []struct {
+		name   string
+		tenant Tenant
+		opts   []FindOption
+	}{
+		{"other tenant", Tenant{"t2", "org"}, []FindOption{OrderBy(OrderName, false)}},
+		{"other tenant type", Tenant{"t1", "team"}, []FindOption{OrderBy(OrderName, false)}},
+		{"other order", t1, []FindOption{OrderBy(OrderCode, false)}},
+		{"other direction", t1, []FindOption{OrderBy(OrderName, true)}},
+		{"other filter", t1, []FindOption{OrderBy(OrderName, false), NameMatches("a")}},
+		{"other match mode", t1, []FindOption{OrderBy(OrderName, false), MatchBy(MatchPrefix)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]FindOption{Limit(1), Cursor(first.NextCursor)}, tt.opts...)
+			if _, err := tq.Find(ctx, tt.tenant, opts...); !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("got %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+
+	// The limit is not part of the shape
+	next, err := tq.Find(ctx, t1, Limit(2), OrderBy(OrderName, false), Cursor(first.NextCursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(next.Nodes); got != "b,c" {
+		t.Fatalf("got %s, want b,c", got)
+	}
+}
+
+func TestCursorRejectsTamperedValues(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	for _, name := range []string{"a", "b", "c"} {
+		mustCreate(t, tq, name, RootPath, "t1", "org")
+	}
+
+	ctx := context.Background()
+	tenant := Tenant{"t1", "org"}
+	cursorFor := func(order Order) string {
+		page, err := tq.Find(ctx, tenant, Limit(1), OrderBy(order, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page.NextCursor
+	}
+	byName, byPosition := cursorFor(OrderName), cursorFor(OrderPosition)
+
+	tests := []struct {
+		name   string
+		order  Order
+		cursor string
+	}{
+		{"not base64", OrderName, "not a cursor!"},
+		{"not json", OrderName, base64.RawURLEncoding.EncodeToString([]byte("{"))},
+		{"other shape", OrderName, retoken(t, byName, func(token *cursorToken) { token.Shape = "forged" })},
+		{"missing value", OrderName, retoken(t, byName, func(token *cursorToken) { token.Values = token.Values[:1] })},
+		{"extra value", OrderName, retoken(t, byName, func(token *cursorToken) { token.Values = append(token.Values, "x") })},
+		{"number for a name", OrderName, retoken(t, byName, func(token *cursorToken) { token.Values[0] = 1 })},
+		{"null for a code", OrderName, retoken(t, byName, func(token *cursorToken) { token.Values[1] = nil })},
+		{"bool for a code", OrderName, retoken(t, byName, func(token *cursorToken) { token.Values[1] = true })},
+		{"object for a name", OrderName, retoken(t, byName, func(token *cursorToken) { token.Values[0] = map[string]string{"a": "b"} })},
+		{"string for a position", OrderPosition, retoken(t, byPosition, func(token *cursorToken) { token.Values[0] = "0" })},
+		{"fraction for a position", OrderPosition, retoken(t, byPosition, func(token *cursorToken) { token.Values[0] = 0.5 })},
+		{"number for a code", OrderPosition, retoken(t, byPosition, func(token *cursorToken) { token.Values[1] = 1 })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tq.Find(ctx, tenant, Limit(1), OrderBy(tt.order, false), Cursor(tt.cursor))
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Fatalf("got %v, want ErrInvalidCursor", err)
+			}
+		})
+	}
+
+	// Well-typed values are accepted
+	moved := retoken(t, byPosition, func(token *cursorToken) { token.Values[0] = 0 })
+	if _, err := tq.Find(ctx, tenant, Limit(1), OrderBy(OrderPosition, false), Cursor(moved)); err != nil {
+		t.Fatalf("got %v for a valid position", err)
+	}
+}
+
+func TestKeysetPagingWithTies(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	for i, name := range []string{"same", "same", "other", "same", "other", "same", "other"} {
+		node := mustCreate(t, tq, name, RootPath, "t1", "org")
+		if err := tq.UpdateNode(node.Code, "t1", "org", map[string]interface{}{"position": i % 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		order Order
+		desc  bool
+	}{
+		{OrderName, false},
+		{OrderName, true},
+		{OrderPosition, false},
+		{OrderPosition, true},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 3} {
+			keys, err := tt.order.sortKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var all []*TreeNode
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 7 {
+					t.Fatalf("%s desc=%v limit %d: paging does not end", tt.order, tt.desc, limit)
+				}
+
+				opts := []FindOption{Limit(limit), OrderBy(tt.order, tt.desc)}
+				if cursor != "" {
+					opts = append(opts, Cursor(cursor))
+				}
+				page, err := tq.Find(context.Background(), Tenant{"t1", "org"}, opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				all = append(all, page.Nodes...)
+				if cursor = page.NextCursor; cursor == "" {
+					break
+				}
+			}
+
+			if len(all) != 7 {
+				t.Fatalf("%s desc=%v limit %d: got %d nodes across pages, want 7", tt.order, tt.desc, limit, len(all))
+			}
+			for i := 1; i < len(all); i++ {
+				c := compareSortValues(all[i-1].sortValues(keys), all[i].sortValues(keys))
+				if tt.desc {
+					c = -c
+				}
+				if c >= 0 {
+					t.Fatalf("%s desc=%v limit %d: %s before %s is out of order or repeated",
+						tt.order, tt.desc, limit, all[i-1].Code, all[i].Code)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package materialized
+
+import (
+	"gorm.io/gorm"
+)
+
+// Expansion is the result of ExpandTo
+type Expansion struct {
+	// Root is the top of the nested tree, the tenant's root node or a virtual
+	// root without an ID
+	Root *TreeNode `json:"root"`
+
+	// Target is the node that was expanded to, also reachable from Root
+	Target *TreeNode `json:"target"`
+}
+
+// expandRow is a child scanned with its rank and the number of its siblings
+type expandRow struct {
+	TreeNode
+	SiblingRank  int64 `gorm:"column:sibling_rank"`
+	SiblingCount int64 `gorm:"column:sibling_count"`
+}
+
+// ExpandToQuery returns a query builder for the children of the given ancestors,
+// ranked per parent by position, then code, the order of GetChildrenByCodePage.
+// At most childLimit children are kept per parent, plus the ancestors
+// themselves; a childLimit of zero or less keeps all children.
+func (tq *TreeQuery) ExpandToQuery(
+	tx *gorm.DB,
+	ancestors []*TreeNode,
+	tenantID,
+	tenantType string,
+	childLimit int,
+) *gorm.DB {
+	codes := make([]Code, 0, len(ancestors))
+	paths := make([]Path, 0, len(ancestors))
+	includesRoot := false
+	for _, ancestor := range ancestors {
+		paths = append(paths, ancestor.Path)
+		if ancestor.Path.IsRoot() {
+			includesRoot = true
+		} else {
+			codes = append(codes, ancestor.Code)
+		}
+	}
+
+	// Root-level nodes have no parent_id, so the root's children are matched separately
+	parents := tx.Session(&gorm.Session{NewDB: true}).Where("parent_id IN (?)", codes)
+	if includesRoot {
+		parents = parents.Or("parent_id IS NULL AND path != ?", string(RootPath))
+	}
+
+	ranked := tq.scoped(tx, tenantID, tenantType).
+		Model(&TreeNode{}).
+		Select("*, " +
+			"ROW_NUMBER() OVER (PARTITION BY COALESCE(parent_id, '') ORDER BY position, code) AS sibling_rank, " +
+			"COUNT(*) OVER (PARTITION BY COALESCE(parent_id, '')) AS sibling_count").
+		Where(parents)
+
+	query := tx.Table("(?) AS expanded", ranked)
+	if childLimit > 0 {
+		query = query.Where("sibling_rank <= ? OR path IN (?)", childLimit, paths)
+	}
+
+	return query
+}
+
+// ExpandTo retrieves the tree from the root down to the node with the given code,
+// with the children of every node on the way loaded so a tree UI can reveal the
+// node among its siblings. The target node is flagged with Target.
+//
+// Each level holds at most childLimit children, always including the next node
+// on the way; ChildCount on each expanded node tells how many children exist in
+// total. Children are ordered by position, then code. A level cut off by the
+// limit carries a ChildrenCursor on its parent that continues after its first
+// childLimit children with GetChildrenByCodePage, so the next node on the way
+// may appear again on a later page. The target's own children are loaded as well.
+//
+// Root is the tenant's root node, or a virtual root without an ID when the
+// tenant has no root row. It runs three queries regardless of depth: the target
+// lookup, the ancestors and one ranked fetch of all their children.
+func (tq *TreeQuery) ExpandTo(code Code, tenantID, tenantType string, childLimit int) (*Expansion, error) {
+	keys, err := OrderPosition.sortKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := tq.GetNodeByCode(code, tenantID, tenantType)
+	if err != nil {
+		return nil, err
+	}
+
+	var ancestors []*TreeNode
+	if err := tq.GetAncestorsQuery(tq.db, target.Path, tenantID, tenantType).
+		Find(&ancestors).Error; err != nil {
+		return nil, err
+	}
+
+	// The root level is expanded even when the tenant has no root row
+	if len(ancestors) == 0 || !ancestors[0].Path.IsRoot() {
+		ancestors = append([]*TreeNode{{Path: RootPath}}, ancestors...)
+	}
+
+	var rows []*expandRow
+	if err := tq.ExpandToQuery(tq.db, ancestors, tenantID, tenantType, childLimit).
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	// Ancestors are used as loaded, their rows among the children are skipped
+	byPath := make(map[Path]*TreeNode, len(ancestors)+len(rows))
+	nodes := make([]*TreeNode, 0, len(ancestors)+len(rows))
+	for _, ancestor := range ancestors {
+		byPath[ancestor.Path] = ancestor
+		nodes = append(nodes, ancestor)
+	}
+
+	// The last child within the limit of each level cut off by it
+	lastRanked := make(map[*TreeNode]*TreeNode)
+	for _, row := range rows {
+		node := row.TreeNode
+
+		if parentPath, err := row.Path.Parent(); err == nil {
+			if parent, ok := byPath[parentPath]; ok {
+				parent.ChildCount = row.SiblingCount
+				parent.HasChildren = row.SiblingCount > 0
+				if childLimit > 0 && row.SiblingRank == int64(childLimit) && row.SiblingCount > row.SiblingRank {
+					lastRanked[parent] = &node
+				}
+			}
+		}
+
+		if _, isAncestor := byPath[row.Path]; isAncestor {
+			continue
+		}
+		nodes = append(nodes, &node)
+	}
+
+	tenant := Tenant{tenantID, tenantType}
+	for parent, last := range lastRanked {
+		shape := newFindOptions(childrenPageOptions(parent.Code)).shape(tenant)
+		if parent.ChildrenCursor, err = encodeCursor(shape, last.sortValues(keys)); err != nil {
+			return nil, err
+		}
+	}
+
+	root, err := nestNodes(nodes, RootPath, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	target = byPath[target.Path]
+	target.Target = true
+
+	return &Expansion{Root: root, Target: target}, nil
+}
@@ -0,0 +1,90 @@
+package materialized
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestExpandTo(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	// Five root-level nodes and five children of the second, all at position 0,
+	// so they are ordered by code, i.e. creation order
+	var top, children []*TreeNode
+	for i := 0; i < 5; i++ {
+		top = append(top, mustCreate(t, tq, fmt.Sprintf("top %d", 4-i), RootPath, "t1", "org"))
+	}
+	for i := 0; i < 5; i++ {
+		children = append(children, mustCreate(t, tq, fmt.Sprintf("child %d", 4-i), top[1].Path, "t1", "org"))
+	}
+	target := children[3]
+	mustCreate(t, tq, "below target", target.Path, "t1", "org")
+
+	expansion, err := tq.ExpandTo(target.Code, "t1", "org", 2)
+	if err != nil {
+		t.Fatalf("expand without a root row: %v", err)
+	}
+
+	root := expansion.Root
+	if root.Path != RootPath || root.ChildCount != 5 {
+		t.Fatalf("got root %s with %d children, want the virtual root with 5", root.Path, root.ChildCount)
+	}
+	if got := codes(root.Children); !equalCodes(got, []Code{top[0].Code, top[1].Code}) {
+		t.Fatalf("got root children %v, want the first two by code, not by name", got)
+	}
+
+	parent := root.Children[1]
+	if got := codes(parent.Children); !equalCodes(got, []Code{children[0].Code, children[1].Code, target.Code}) {
+		t.Fatalf("got children %v, want the first two and the target", got)
+	}
+	if !expansion.Target.Target || parent.Children[2] != expansion.Target || len(expansion.Target.Children) != 1 {
+		t.Fatal("the target is not flagged, nested or expanded")
+	}
+	for _, child := range parent.Children[:2] {
+		if child.Target {
+			t.Fatalf("%s is flagged as the target", child.Name)
+		}
+	}
+
+	// Each cut-off level continues after its first two children
+	page, err := tq.GetChildrenByCodePage(parent.Code, "t1", "org", 10, parent.ChildrenCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := codes(page.Nodes); !equalCodes(got, codes(children[2:])) {
+		t.Fatalf("got next children %v, want the last three", got)
+	}
+
+	page, err = tq.GetChildrenByCodePage("", "t1", "org", 10, root.ChildrenCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := codes(page.Nodes); !equalCodes(got, codes(top[2:])) {
+		t.Fatalf("got next root-level nodes %v, want the last three", got)
+	}
+
+	// Levels within the limit have no cursor
+	if expansion.Target.ChildrenCursor != "" {
+		t.Fatal("the target's children are complete but have a cursor")
+	}
+}
+
+func codes(nodes []*TreeNode) []Code {
+	result := make([]Code, len(nodes))
+	for i, node := range nodes {
+		result[i] = node.Code
+	}
+	return result
+}
+
+func equalCodes(a, b []Code) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,467 @@
+package materialized
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// depthSQL computes the depth of a node from its path.
+// Root-level nodes have depth 1, matching Path.Depth.
+const depthSQL = "(LENGTH(path) - LENGTH(REPLACE(path, '" + PathSeparator + "', '')))"
+
+// Order identifies a sort order supported by Find
+type Order string
+
+const (
+	// OrderPath sorts nodes depth-first
+	OrderPath Order = "path"
+
+	// OrderName sorts nodes by name
+	OrderName Order = "name"
+
+	// OrderCode sorts nodes by code, which is creation time for ULID codes
+	OrderCode Order = "code"
+
+	// OrderPosition sorts nodes by their position among siblings
+	OrderPosition Order = "position"
+)
+
+// MatchMode selects how NameMatches compares names with the query
+type MatchMode string
+
+const (
+	// MatchContains matches names containing the query
+	MatchContains MatchMode = "contains"
+
+	// MatchPrefix matches names starting with the query
+	MatchPrefix MatchMode = "prefix"
+
+	// MatchExact matches names equal to the query
+	MatchExact MatchMode = "exact"
+)
+
+// likeEscape is the escape character of the LIKE patterns built from user input.
+// A character without special meaning in string literals keeps it portable.
+const likeEscape = "!"
+
+// escapeLike escapes LIKE wildcards in s so they are matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(
+		likeEscape, likeEscape+likeEscape,
+		"%", likeEscape+"%",
+		"_", likeEscape+"_",
+	).Replace(s)
+}
+
+// pattern returns the LIKE pattern matching query in the mode
+func (m MatchMode) pattern(query string) (string, error) {
+	switch m {
+	case MatchContains:
+		return "%" + escapeLike(query) + "%", nil
+	case MatchPrefix:
+		return escapeLike(query) + "%", nil
+	case MatchExact:
+		return escapeLike(query), nil
+	}
+
+	return "", fmt.Errorf("unsupported match mode %q", string(m))
+}
+
+// sortKeys returns the columns that make up the keyset of the order.
+// Every order ends with a unique column so pages never overlap.
+func (o Order) sortKeys() ([]string, error) {
+	switch o {
+	case OrderPath:
+		return []string{"path"}, nil
+	case OrderName:
+		return []string{"name", "code"}, nil
+	case OrderCode:
+		return []string{"code"}, nil
+	case OrderPosition:
+		return []string{"position", "code"}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported order %q", string(o))
+}
+
+// rankOrder orders NameMatches results by relevance: exact matches first, then
+// prefix matches, then the rest, each shallowest first. It is a single expression
+// because GORM drops an ORDER BY expression when further columns are added.
+func (o *findOptions) rankOrder() clause.OrderBy {
+	tail := depthSQL + ", name, code"
+	if o.nameQuery == nil {
+		return clause.OrderBy{Expression: clause.Expr{SQL: tail, WithoutParentheses: true}}
+	}
+
+	column, value := "name", *o.nameQuery
+	if o.ignoreCase {
+		column, value = "LOWER(name)", strings.ToLower(value)
+	}
+
+	return clause.OrderBy{Expression: clause.Expr{
+		SQL: "CASE WHEN " + column + " = ? THEN 0 WHEN " + column +
+			" LIKE ? ESCAPE '" + likeEscape + "' THEN 1 ELSE 2 END, " + tail,
+		Vars:               []interface{}{value, escapeLike(value) + "%"},
+		WithoutParentheses: true,
+	}}
+}
+
+// FindOption configures a Find query
+type FindOption func(*findOptions)
+
+type findOptions struct {
+	subtree          *Path
+	parent           *Code
+	depth            *int
+	maxRelativeDepth *int
+	owner            *OwnerFields
+	nameLike         string
+	nameQuery        *string
+	matchMode        MatchMode
+	ignoreCase       bool
+	minDepth         *int
+	maxDepth         *int
+	createdFrom      time.Time
+	createdTo        time.Time
+	updatedFrom      time.Time
+	updatedTo        time.Time
+	metadata         map[string]string
+	order            Order
+	desc             bool
+	limit            int
+	cursor           string
+}
+
+// InSubtree restricts results to the descendants of the node at path
+func InSubtree(path Path) FindOption {
+	return func(o *findOptions) {
+		o.subtree = &path
+	}
+}
+
+// ChildrenOf restricts results to the direct children of the node with code
+func ChildrenOf(code Code) FindOption {
+	return func(o *findOptions) {
+		o.parent = &code
+	}
+}
+
+// AtDepth restricts results to nodes at an absolute depth.
+// Depth 0 is the root node.
+func AtDepth(depth int) FindOption {
+	return func(o *findOptions) {
+		o.depth = &depth
+	}
+}
+
+// MaxRelativeDepth restricts results to nodes at most depth levels below the
+// InSubtree path, or below the root when no subtree is given. The node the
+// depth is measured from is not included, the root node neither.
+func MaxRelativeDepth(depth int) FindOption {
+	return func(o *findOptions) {
+		o.maxRelativeDepth = &depth
+	}
+}
+
+// OwnedBy restricts results to nodes associated with owner
+func OwnedBy(owner OwnerFields) FindOption {
+	return func(o *findOptions) {
+		o.owner = &owner
+	}
+}
+
+// NameLike restricts results to nodes whose name matches the SQL LIKE pattern
+func NameLike(pattern string) FindOption {
+	return func(o *findOptions) {
+		o.nameLike = pattern
+	}
+}
+
+// NameMatches restricts results to nodes whose name matches query in the mode
+// set by MatchBy, MatchContains by default. Unlike NameLike, % and _ in query
+// are matched literally.
+func NameMatches(query string) FindOption {
+	return func(o *findOptions) {
+		o.nameQuery = &query
+	}
+}
+
+// MatchBy sets how NameMatches compares names with the query
+func MatchBy(mode MatchMode) FindOption {
+	return func(o *findOptions) {
+		o.matchMode = mode
+	}
+}
+
+// IgnoreCase makes NameMatches case-insensitive on every database
+func IgnoreCase() FindOption {
+	return func(o *findOptions) {
+		o.ignoreCase = true
+	}
+}
+
+// DepthBetween restricts results to nodes at absolute depths from min to max,
+// both included. Depth 0 is the root node.
+func DepthBetween(min, max int) FindOption {
+	return func(o *findOptions) {
+		o.minDepth = &min
+		o.maxDepth = &max
+	}
+}
+
+// CreatedBetween restricts results to nodes created at or after from and before
+// to, with millisecond precision. A zero time leaves that end open.
+// The creation time is read from the ULID codes, so the range is compiled into
+// code bounds served by the code index; nodes with assigned codes count as
+// created at the time of their codes, and the root node is never matched.
+func CreatedBetween(from, to time.Time) FindOption {
+	return func(o *findOptions) {
+		o.createdFrom = from
+		o.createdTo = to
+	}
+}
+
+// UpdatedBetween restricts results to nodes updated at or after from and before
+// to. A zero time leaves that end open.
+func UpdatedBetween(from, to time.Time) FindOption {
+	return func(o *findOptions) {
+		o.updatedFrom = from
+		o.updatedTo = to
+	}
+}
+
+// MetadataEquals restricts results to nodes whose metadata holds the string
+// value under key. It can be given several times to match several keys.
+func MetadataEquals(key, value string) FindOption {
+	return func(o *findOptions) {
+		if o.metadata == nil {
+			o.metadata = make(map[string]string)
+		}
+		o.metadata[key] = value
+	}
+}
+
+// OrderBy sets the sort order of the results. The default is OrderPath.
+func OrderBy(order Order, desc bool) FindOption {
+	return func(o *findOptions) {
+		o.order = order
+		o.desc = desc
+	}
+}
+
+// Limit sets the maximum number of nodes in a page. Zero means no limit.
+func Limit(limit int) FindOption {
+	return func(o *findOptions) {
+		o.limit = limit
+	}
+}
+
+// Cursor continues from the NextCursor of a previous page
+func Cursor(cursor string) FindOption {
+	return func(o *findOptions) {
+		o.cursor = cursor
+	}
+}
+
+func newFindOptions(opts []FindOption) *findOptions {
+	o := &findOptions{order: OrderPath, matchMode: MatchContains}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// Page is a page of Find results
+type Page struct {
+	// Nodes holds the nodes of the page
+	Nodes []*TreeNode `json:"nodes"`
+
+	// Total is the number of nodes matching the filters across all pages
+	Total int64 `json:"total"`
+
+	// NextCursor continues with the next page, empty on the last page
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// findRow is a node scanned together with the windowed total count
+type findRow struct {
+	TreeNode
+	TotalCount int64 `gorm:"column:total_count"`
+}
+
+// FindQuery returns a query builder for the nodes matching the filter options.
+// Ordering, limit and cursor options are applied by Find.
+func (tq *TreeQuery) FindQuery(tx *gorm.DB, tenant Tenant, opts ...FindOption) *gorm.DB {
+	return tq.findQuery(tx, tenant, newFindOptions(opts))
+}
+
+func (tq *TreeQuery) findQuery(tx *gorm.DB, tenant Tenant, o *findOptions) *gorm.DB {
+	query := tq.scoped(tx, tenant.ID, tenant.Type)
+
+	base := RootPath
+	if o.subtree != nil {
+		base = *o.subtree
+		query = query.Where("path LIKE ? AND path != ?", base.GetPathPrefix(), string(base))
+	}
+
+	if o.parent != nil {
+		query = query.Where(TreeNode{ParentID: o.parent})
+	}
+
+	if o.depth != nil {
+		if *o.depth == 0 {
+			query = query.Where(TreeNode{Path: RootPath})
+		} else {
+			query = query.Where(depthSQL+" = ? AND path != ?", *o.depth, string(RootPath))
+		}
+	}
+
+	if o.maxRelativeDepth != nil {
+		query = query.Where("path != ? AND "+depthSQL+" <= ?", string(RootPath), base.Depth()+*o.maxRelativeDepth)
+	}
+
+	if o.owner != nil {
+		query = query.Scopes(tq.ownerScope(o.owner.ID, o.owner.Type))
+	}
+
+	if o.nameLike != "" {
+		query = query.Where("name LIKE ?", o.nameLike)
+	}
+
+	if o.nameQuery != nil {
+		column, value := "name", *o.nameQuery
+		if o.ignoreCase {
+			column, value = "LOWER(name)", strings.ToLower(value)
+		}
+
+		pattern, err := o.matchMode.pattern(value)
+		if err != nil {
+			query.AddError(err)
+			return query
+		}
+		query = query.Where(column+" LIKE ? ESCAPE '"+likeEscape+"'", pattern)
+	}
+
+	if o.minDepth != nil && o.maxDepth != nil {
+		switch {
+		case *o.maxDepth < *o.minDepth || *o.maxDepth < 0:
+			query = query.Where("1 = 0")
+		case *o.minDepth <= 0:
+			// The root counts as depth 1 in depthSQL, like its children
+			query = query.Where("path = ? OR "+depthSQL+" <= ?", string(RootPath), *o.maxDepth)
+		default:
+			query = query.Where("path != ? AND "+depthSQL+" BETWEEN ? AND ?",
+				string(RootPath), *o.minDepth, *o.maxDepth)
+		}
+	}
+
+	if !o.createdFrom.IsZero() || !o.createdTo.IsZero() {
+		// The lower bound is always set, as it excludes the root's empty code
+		query = query.Where("code >= ?", minNodeIDAt(o.createdFrom))
+		if !o.createdTo.IsZero() {
+			query = query.Where("code < ?", minNodeIDAt(o.createdTo))
+		}
+	}
+	if !o.updatedFrom.IsZero() {
+		query = query.Where("updated_at >= ?", o.updatedFrom)
+	}
+	if !o.updatedTo.IsZero() {
+		query = query.Where("updated_at < ?", o.updatedTo)
+	}
+
+	// Keys are sorted so the statement is the same for the same options
+	keys := make([]string, 0, len(o.metadata))
+	for key := range o.metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		sql, path := metadataValueSQL(tx, key)
+		query = query.Where(sql+" = ?", path, o.metadata[key])
+	}
+
+	return query
+}
+
+// Find retrieves a page of nodes matching the options.
+// Filters, ordering, cursor and the total count are compiled into a single
+// statement; a page past the last row counts the total with a second one.
+func (tq *TreeQuery) Find(ctx context.Context, tenant Tenant, opts ...FindOption) (*Page, error) {
+	return tq.find(tq.db.WithContext(ctx), tenant, newFindOptions(opts))
+}
+
+func (tq *TreeQuery) find(db *gorm.DB, tenant Tenant, o *findOptions) (*Page, error) {
+	keys, err := o.order.sortKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// The total is computed over the filtered set before the cursor is applied
+	inner := tq.findQuery(db, tenant, o).
+		Model(&TreeNode{}).
+		Select("*, COUNT(*) OVER () AS total_count")
+
+	query := db.Table("(?) AS page", inner)
+
+	shape := o.shape(tenant)
+
+	if o.cursor != "" {
+		values, err := decodeCursor(o.cursor, shape, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		query = query.Where(keysetCondition(keys, values, o.desc))
+	}
+
+	direction := "ASC"
+	if o.desc {
+		direction = "DESC"
+	}
+	for _, key := range keys {
+		query = query.Order(key + " " + direction)
+	}
+
+	// Fetch one extra row to know whether another page follows
+	if o.limit > 0 {
+		query = query.Limit(o.limit + 1)
+	}
+
+	var rows []*findRow
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	page := &Page{Nodes: make([]*TreeNode, 0, len(rows))}
+	if len(rows) > 0 {
+		page.Total = rows[0].TotalCount
+	} else if o.cursor != "" {
+		// A cursor past the last row leaves no row to read the total from
+		if err := tq.findQuery(db, tenant, o).Model(&TreeNode{}).Count(&page.Total).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if o.limit > 0 && len(rows) > o.limit {
+		rows = rows[:o.limit]
+
+		page.NextCursor, err = encodeCursor(shape, rows[len(rows)-1].sortValues(keys))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, row := range rows {
+		node := row.TreeNode
+		page.Nodes = append(page.Nodes, &node)
+	}
+
+	return page, nil
+}
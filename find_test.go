@@ -0,0 +1,225 @@
+package materialized
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFindTotalPastLastRow(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	tenant := Tenant{"t1", "org"}
+
+	var nodes []*TreeNode
+	for _, name := range []string{"a", "b", "c"} {
+		nodes = append(nodes, mustCreate(t, tq, name, RootPath, tenant.ID, tenant.Type))
+	}
+
+	first, err := tq.Find(context.Background(), tenant, Limit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Total != 3 || first.NextCursor == "" {
+		t.Fatalf("got total %d and cursor %q, want 3 and a cursor", first.Total, first.NextCursor)
+	}
+
+	// The rest of the set goes away before the next page is read
+	if err := tq.DeleteNode(nodes[2].Path, tenant.ID, tenant.Type, false); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := tq.Find(context.Background(), tenant, Limit(2), Cursor(first.NextCursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Nodes) != 0 {
+		t.Fatalf("got %d nodes, want none", len(next.Nodes))
+	}
+	if next.Total != 2 {
+		t.Fatalf("got total %d past the last row, want 2", next.Total)
+	}
+}
+
+// findFixture builds root -> a -> b -> c and root -> d in t1, with b owned by
+// someone else, and a node in t2
+func findFixture(t *testing.T, tq *TreeQuery) map[string]*TreeNode {
+	t.Helper()
+
+	nodes := map[string]*TreeNode{}
+	root, err := tq.GetRootNode("t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes["root"] = root
+	nodes["a"] = mustCreate(t, tq, "a", RootPath, "t1", "org")
+	if nodes["b"], err = tq.CreateNode("b", nodes["a"].Path, "t1", "org", "someone", "user"); err != nil {
+		t.Fatal(err)
+	}
+	nodes["c"] = mustCreate(t, tq, "c", nodes["b"].Path, "t1", "org")
+	nodes["d"] = mustCreate(t, tq, "d", RootPath, "t1", "org")
+	mustCreate(t, tq, "e", RootPath, "t2", "org")
+
+	return nodes
+}
+
+func TestFindFilters(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	nodes := findFixture(t, tq)
+	a := nodes["a"]
+
+	tests := []struct {
+		name string
+		opts []FindOption
+		want string
+	}{
+		{"all", nil, "root,a,b,c,d"},
+		{"in subtree", []FindOption{InSubtree(a.Path)}, "b,c"},
+		{"children of", []FindOption{ChildrenOf(a.Code)}, "b"},
+		{"at depth 0", []FindOption{AtDepth(0)}, "root"},
+		{"at depth 1", []FindOption{AtDepth(1)}, "a,d"},
+		{"at depth 2", []FindOption{AtDepth(2)}, "b"},
+		{"max relative depth 0", []FindOption{MaxRelativeDepth(0)}, ""},
+		{"max relative depth 1", []FindOption{MaxRelativeDepth(1)}, "a,d"},
+		{"max relative depth 2", []FindOption{MaxRelativeDepth(2)}, "a,b,d"},
+		{"max relative depth in subtree", []FindOption{InSubtree(a.Path), MaxRelativeDepth(1)}, "b"},
+		{"owned by", []FindOption{OwnedBy(OwnerFields{"someone", "user"})}, "b"},
+		{"name like", []FindOption{NameLike("_")}, "a,b,c,d"},
+		{"depth between 0 and 1", []FindOption{DepthBetween(0, 1)}, "root,a,d"},
+		{"depth between 2 and 3", []FindOption{DepthBetween(2, 3)}, "b,c"},
+		{"empty depth range", []FindOption{DepthBetween(2, 1)}, ""},
+		{"order by name", []FindOption{DepthBetween(1, 3), OrderBy(OrderName, true)}, "d,c,b,a"},
+		{"combined", []FindOption{InSubtree(a.Path), OwnedBy(OwnerFields{"owner", "user"})}, "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := tq.Find(context.Background(), Tenant{"t1", "org"}, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(page.Nodes); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+			if page.Total != int64(len(page.Nodes)) || page.NextCursor != "" {
+				t.Fatalf("got total %d and cursor %q for a single page", page.Total, page.NextCursor)
+			}
+		})
+	}
+}
+
+func TestFindUpdatedBetween(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	nodes := findFixture(t, tq)
+
+	from := tick()
+	if err := tq.UpdateNode(nodes["c"].Code, "t1", "org", map[string]interface{}{"position": 1}); err != nil {
+		t.Fatal(err)
+	}
+	to := tick()
+
+	for _, tt := range []struct {
+		name     string
+		from, to time.Time
+		want     string
+	}{
+		{"window", from, to, "c"},
+		{"open end", from, time.Time{}, "c"},
+		{"open start", time.Time{}, from, "root,a,b,d"},
+		{"after", to, time.Time{}, ""},
+	} {
+		page, err := tq.Find(context.Background(), Tenant{"t1", "org"}, UpdatedBetween(tt.from, tt.to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(page.Nodes); got != tt.want {
+			t.Fatalf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFindPages(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	findFixture(t, tq)
+
+	var all []*TreeNode
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("paging does not end")
+		}
+
+		opts := []FindOption{Limit(2), OrderBy(OrderName, false)}
+		if cursor != "" {
+			opts = append(opts, Cursor(cursor))
+		}
+		page, err := tq.Find(context.Background(), Tenant{"t1", "org"}, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 5 {
+			t.Fatalf("got total %d, want 5", page.Total)
+		}
+
+		all = append(all, page.Nodes...)
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+
+	if got := names(all); got != "a,b,c,d,root" {
+		t.Fatalf("got %s across pages, want a,b,c,d,root", got)
+	}
+}
+
+func TestFindCreatedBetween(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	from := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Millisecond)
+
+	if _, err := tq.GetRootNode("t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	for name, code := range map[string]Code{
+		"just before": nodeIDAt(t, from.Add(-time.Millisecond), 0xff),
+		"first":       nodeIDAt(t, from, 0x00),
+		"last":        nodeIDAt(t, to.Add(-time.Millisecond), 0xff),
+		"just after":  nodeIDAt(t, to, 0x00),
+	} {
+		if _, err := tq.CreateNode(name, RootPath, "t1", "org", "owner", "user", AssignCode(code)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tq.WithIDGenerator(NewSeededIDGenerator(1, from)).
+		CreateNode("generated", RootPath, "t1", "org", "owner", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tq.WithIDGenerator(NewSeededIDGenerator(2, from)).
+		CreateNode("other tenant", RootPath, "t2", "org", "owner", "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     string
+	}{
+		{"window", from, to, "first,generated,last"},
+		{"within the first millisecond", from.Add(time.Millisecond / 2), to, "first,generated,last"},
+		{"first millisecond only", from, from.Add(time.Millisecond), "first,generated"},
+		{"open end", from, time.Time{}, "first,generated,just after,last"},
+		{"open start", time.Time{}, from, "just before"},
+		{"before the epoch", time.UnixMilli(-1), from, "just before"},
+		{"empty", to, from, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := tq.Find(context.Background(), Tenant{"t1", "org"},
+				CreatedBetween(tt.from, tt.to), OrderBy(OrderName, false))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(page.Nodes); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
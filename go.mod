@@ -4,11 +4,13 @@ go 1.24.0
 
 require (
 	github.com/oklog/ulid/v2 v2.1.0
+	gorm.io/driver/sqlite v1.5.7
 	gorm.io/gorm v1.25.12
 )
 
 require (
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
+	github.com/mattn/go-sqlite3 v1.14.22 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
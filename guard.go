@@ -0,0 +1,467 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrTenantScopeMissing is returned when a statement on the tree table has no tenant predicate
+	ErrTenantScopeMissing = errors.New("statement on tree table is missing tenant scope")
+)
+
+const (
+	// crossTenantKey marks a statement as an intentional cross-tenant operation
+	crossTenantKey = "materialized:cross_tenant"
+
+	tenantIDColumn   = "tenant_id"
+	tenantTypeColumn = "tenant_type"
+)
+
+// simplePredicateRegexp matches a single "column = ?" or "column IN (?)" condition,
+// optionally quoted and qualified with a table name
+var simplePredicateRegexp = regexp.MustCompile("(?i)^\\(?\\s*[`\"]?(?:\\w+[`\"]?\\.[`\"]?)?(\\w+)[`\"]?\\s*(?:=\\s*[?@]|IN\\s*\\(?\\s*[?@])")
+
+// orRegexp matches OR as a word, whatever surrounds it
+var orRegexp = regexp.MustCompile("(?i)\\bOR\\b")
+
+// CrossTenant marks every statement built from db as an intentional cross-tenant
+// operation, exempting it from the TenantGuard checks.
+// Use it only for administrative tasks such as migrations and reporting.
+func CrossTenant(db *gorm.DB) *gorm.DB {
+	return db.Set(crossTenantKey, true).Session(&gorm.Session{})
+}
+
+// CrossTenant returns a TreeQuery whose statements are exempt from the TenantGuard checks
+func (tq *TreeQuery) CrossTenant() *TreeQuery {
+	return tq.clone(CrossTenant(tq.db))
+}
+
+// TenantGuard is a GORM plugin that checks every query, update and delete on the
+// tree table for tenant_id and tenant_type predicates. This catches statements
+// that bypass tenantScope, for example a bare db.Table("tree_nodes") or a query
+// builder extended with an OR clause that escapes the scope.
+//
+// Subqueries passed as arguments, e.g. to WHERE ... IN (?), Table("(?) AS x")
+// or Joins, are checked the same way. Statements the guard cannot verify are
+// rejected: joins of the tree table and raw SQL mentioning it.
+// Statements marked with CrossTenant are not checked. Creates are not inspected.
+type TenantGuard struct {
+	// TableName is the name of the tree table to guard
+	TableName string
+
+	// LogOnly reports violations through the GORM logger instead of rejecting them
+	LogOnly bool
+}
+
+// NewTenantGuard creates a TenantGuard for the table in config
+func NewTenantGuard(config TableConfig) *TenantGuard {
+	return &TenantGuard{
+		TableName: config.TableName,
+	}
+}
+
+// Name returns the plugin name
+func (g *TenantGuard) Name() string {
+	return "materialized:tenant_guard"
+}
+
+// Initialize registers the guard callbacks on db
+func (g *TenantGuard) Initialize(db *gorm.DB) error {
+	if g.TableName == "" {
+		return ErrInvalidTableConfig
+	}
+
+	name := g.Name()
+	if err := db.Callback().Query().Before("gorm:query").Register(name, g.check); err != nil {
+		return err
+	}
+	if err := db.Callback().Row().Before("gorm:row").Register(name, g.check); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register(name, g.check); err != nil {
+		return err
+	}
+	if err := db.Callback().Raw().Before("gorm:raw").Register(name, g.check); err != nil {
+		return err
+	}
+	return db.Callback().Delete().Before("gorm:delete").Register(name, g.check)
+}
+
+// check inspects the statement and rejects or logs it when the tenant scope is missing
+func (g *TenantGuard) check(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+
+	err := g.verify(db)
+	if err == nil {
+		return
+	}
+
+	if g.LogOnly {
+		db.Logger.Warn(db.Statement.Context, "%s", err)
+		return
+	}
+
+	db.AddError(err)
+}
+
+// verify returns an error wrapping ErrTenantScopeMissing when the statement,
+// or a statement nested in it, is not restricted to a tenant
+func (g *TenantGuard) verify(db *gorm.DB) error {
+	if crossTenant, ok := db.Get(crossTenantKey); ok && crossTenant == true {
+		return nil
+	}
+
+	stmt := db.Statement
+
+	// Raw SQL has its subqueries rendered already and cannot be analysed
+	if stmt.SQL.Len() > 0 {
+		if g.mentionsTable(stmt.SQL.String()) {
+			return fmt.Errorf("%w: raw SQL on %s", ErrTenantScopeMissing, g.TableName)
+		}
+		return nil
+	}
+
+	if g.targetsTable(stmt) {
+		var exprs []clause.Expression
+		if c, ok := stmt.Clauses["WHERE"]; ok {
+			if where, ok := c.Expression.(clause.Where); ok {
+				exprs = where.Exprs
+			}
+		}
+
+		columns := whereColumns(exprs)
+		if !columns[tenantIDColumn] || !columns[tenantTypeColumn] {
+			return fmt.Errorf("%w: %s", ErrTenantScopeMissing, g.TableName)
+		}
+	}
+
+	if err := g.verifyJoins(stmt); err != nil {
+		return err
+	}
+
+	for _, nested := range nestedStatements(stmt) {
+		if err := g.verifyNested(nested); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyNested checks a subquery by building it without running it, which
+// applies its scopes and runs the guard on it
+func (g *TenantGuard) verifyNested(nested *gorm.DB) error {
+	if nested.Statement.SQL.Len() > 0 {
+		return g.verify(nested)
+	}
+
+	var rows []map[string]interface{}
+	err := nested.Session(&gorm.Session{DryRun: true}).Find(&rows).Error
+	if errors.Is(err, ErrTenantScopeMissing) {
+		return err
+	}
+
+	return nil
+}
+
+// joinTargetRegexp matches the table joined by a JOIN clause written as SQL
+var joinTargetRegexp = regexp.MustCompile("(?i)\\bJOIN\\s+([^\\s(]+)")
+
+// verifyJoins rejects joins of the tree table, whose tenant scope would have
+// to be found in the ON conditions
+func (g *TenantGuard) verifyJoins(stmt *gorm.Statement) error {
+	for _, join := range stmt.Joins {
+		if stmt.Schema != nil {
+			if rel, ok := stmt.Schema.Relationships.Relations[join.Name]; ok {
+				if rel.FieldSchema.Table == g.TableName || (rel.FieldSchema == stmt.Schema && g.targetsTable(stmt)) {
+					return fmt.Errorf("%w: %s joined by %s", ErrTenantScopeMissing, g.TableName, join.Name)
+				}
+				continue
+			}
+		}
+
+		for _, match := range joinTargetRegexp.FindAllStringSubmatch(join.Name, -1) {
+			if g.isTable(match[1]) {
+				return fmt.Errorf("%w: %s joined", ErrTenantScopeMissing, g.TableName)
+			}
+		}
+	}
+
+	if c, ok := stmt.Clauses["FROM"]; ok {
+		if from, ok := c.Expression.(clause.From); ok {
+			for _, join := range from.Joins {
+				if g.isTable(join.Table.Name) {
+					return fmt.Errorf("%w: %s joined", ErrTenantScopeMissing, g.TableName)
+				}
+				if expr, ok := join.Expression.(clause.Expr); ok {
+					for _, match := range joinTargetRegexp.FindAllStringSubmatch(expr.SQL, -1) {
+						if g.isTable(match[1]) {
+							return fmt.Errorf("%w: %s joined", ErrTenantScopeMissing, g.TableName)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// isTable reports whether a possibly quoted or schema-qualified name is the tree table
+func (g *TenantGuard) isTable(name string) bool {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return strings.Trim(name, "`\"[]") == g.TableName
+}
+
+// mentionsTable reports whether the SQL contains the tree table's name as a word
+func (g *TenantGuard) mentionsTable(sql string) bool {
+	for _, field := range strings.FieldsFunc(sql, func(r rune) bool {
+		return !(r == '_' || r == '$' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+	}) {
+		if field == g.TableName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nestedStatements returns the subqueries passed as arguments anywhere in the statement
+func nestedStatements(stmt *gorm.Statement) []*gorm.DB {
+	var nested []*gorm.DB
+	collect := func(v interface{}) {
+		collectStatements(v, &nested)
+	}
+
+	if stmt.TableExpr != nil {
+		collect(*stmt.TableExpr)
+	}
+	for _, join := range stmt.Joins {
+		collect(join.Conds)
+		if join.On != nil {
+			collect(*join.On)
+		}
+	}
+	for _, c := range stmt.Clauses {
+		collect(c.Expression)
+		collect(c.BeforeExpression)
+		collect(c.AfterExpression)
+	}
+
+	return nested
+}
+
+// collectStatements appends the subqueries found in a clause expression or argument
+func collectStatements(v interface{}, nested *[]*gorm.DB) {
+	switch e := v.(type) {
+	case *gorm.DB:
+		*nested = append(*nested, e)
+	case []interface{}:
+		for _, item := range e {
+			collectStatements(item, nested)
+		}
+	case [][]interface{}:
+		for _, item := range e {
+			collectStatements(item, nested)
+		}
+	case []clause.Expression:
+		for _, item := range e {
+			collectStatements(item, nested)
+		}
+	case clause.Expr:
+		collectStatements(e.Vars, nested)
+	case clause.NamedExpr:
+		collectStatements(e.Vars, nested)
+	case clause.Where:
+		collectStatements(e.Exprs, nested)
+	case clause.AndConditions:
+		collectStatements(e.Exprs, nested)
+	case clause.OrConditions:
+		collectStatements(e.Exprs, nested)
+	case clause.NotConditions:
+		collectStatements(e.Exprs, nested)
+	case clause.IN:
+		collectStatements(e.Values, nested)
+	case clause.Eq:
+		collectStatements(e.Value, nested)
+	case clause.Neq:
+		collectStatements(e.Value, nested)
+	case clause.Gt:
+		collectStatements(e.Value, nested)
+	case clause.Gte:
+		collectStatements(e.Value, nested)
+	case clause.Lt:
+		collectStatements(e.Value, nested)
+	case clause.Lte:
+		collectStatements(e.Value, nested)
+	case clause.Like:
+		collectStatements(e.Value, nested)
+	case clause.Select:
+		collectStatements(e.Expression, nested)
+	case clause.Set:
+		for _, assignment := range e {
+			collectStatements(assignment.Value, nested)
+		}
+	case clause.Values:
+		collectStatements(e.Values, nested)
+	case clause.From:
+		for _, join := range e.Joins {
+			collectStatements(join.Expression, nested)
+			collectStatements(join.ON, nested)
+		}
+	}
+}
+
+// targetsTable reports whether the statement reads or writes the guarded table
+func (g *TenantGuard) targetsTable(stmt *gorm.Statement) bool {
+	if stmt.Table == g.TableName {
+		return true
+	}
+
+	if stmt.TableExpr != nil {
+		for _, field := range strings.FieldsFunc(stmt.TableExpr.SQL, func(r rune) bool {
+			return r == ' ' || r == ',' || r == '`' || r == '"' || r == '(' || r == ')'
+		}) {
+			if field == g.TableName {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// whereColumns returns the columns that every row matched by the top-level
+// WHERE expressions is constrained on.
+// A single OR condition at the top level splits the expressions into
+// alternatives, so only columns constrained in all of them are returned.
+func whereColumns(exprs []clause.Expression) map[string]bool {
+	if len(exprs) == 1 {
+		if and, ok := exprs[0].(clause.AndConditions); ok {
+			exprs = and.Exprs
+		}
+	}
+
+	var groups []map[string]bool
+	current := map[string]bool{}
+	for _, expr := range exprs {
+		if or, ok := expr.(clause.OrConditions); ok && len(or.Exprs) == 1 {
+			groups = append(groups, current)
+			current = map[string]bool{}
+			expr = or.Exprs[0]
+		}
+
+		for column := range exprColumns(expr) {
+			current[column] = true
+		}
+	}
+	groups = append(groups, current)
+
+	return intersectColumns(groups)
+}
+
+// exprColumns returns the columns a single expression constrains
+func exprColumns(expr clause.Expression) map[string]bool {
+	columns := map[string]bool{}
+
+	switch v := expr.(type) {
+	case clause.Eq:
+		if v.Value != nil {
+			if name := columnName(v.Column); name != "" {
+				columns[name] = true
+			}
+		}
+	case clause.IN:
+		if len(v.Values) > 0 {
+			if name := columnName(v.Column); name != "" {
+				columns[name] = true
+			}
+		}
+	case clause.AndConditions:
+		for _, e := range v.Exprs {
+			for column := range exprColumns(e) {
+				columns[column] = true
+			}
+		}
+	case clause.OrConditions:
+		groups := make([]map[string]bool, 0, len(v.Exprs))
+		for _, e := range v.Exprs {
+			groups = append(groups, exprColumns(e))
+		}
+		return intersectColumns(groups)
+	case clause.Expr:
+		return sqlColumns(v.SQL)
+	case clause.NamedExpr:
+		return sqlColumns(v.SQL)
+	}
+
+	return columns
+}
+
+// sqlColumns extracts the columns of a raw condition made only of simple
+// predicates joined with AND. Anything containing OR is treated as unconstrained.
+func sqlColumns(sql string) map[string]bool {
+	columns := map[string]bool{}
+
+	upper := strings.Join(strings.Fields(strings.ToUpper(sql)), " ")
+	if orRegexp.MatchString(upper) {
+		return columns
+	}
+
+	for _, part := range strings.Split(upper, " AND ") {
+		if match := simplePredicateRegexp.FindStringSubmatch(part); match != nil {
+			columns[strings.ToLower(match[1])] = true
+		}
+	}
+
+	return columns
+}
+
+// columnName returns the bare name of a column expression
+func columnName(column interface{}) string {
+	switch c := column.(type) {
+	case clause.Column:
+		return c.Name
+	case string:
+		if i := strings.LastIndex(c, "."); i >= 0 {
+			c = c[i+1:]
+		}
+		return strings.Trim(c, "`\"")
+	}
+
+	return ""
+}
+
+// intersectColumns returns the columns present in every group
+func intersectColumns(groups []map[string]bool) map[string]bool {
+	result := map[string]bool{}
+	if len(groups) == 0 {
+		return result
+	}
+
+	for column := range groups[0] {
+		shared := true
+		for _, group := range groups[1:] {
+			if !group[column] {
+				shared = false
+				break
+			}
+		}
+		if shared {
+			result[column] = true
+		}
+	}
+
+	return result
+}
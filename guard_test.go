@@ -0,0 +1,235 @@
+package materialized
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newGuardedTree returns a tree with the guard installed and a node in each of two tenants
+func newGuardedTree(t *testing.T) *TreeQuery {
+	t.Helper()
+
+	config := DefaultTableConfig()
+	config.HistoryTableName = "tree_node_history"
+	tq := newTestTree(t, config)
+	if err := tq.db.Use(NewTenantGuard(config)); err != nil {
+		t.Fatalf("use guard: %v", err)
+	}
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	mustCreate(t, tq, "a1", a.Path, "t1", "org")
+	mustCreate(t, tq, "b", RootPath, "t2", "org")
+
+	return tq
+}
+
+func TestTenantGuardRejectsUnscopedStatements(t *testing.T) {
+	tq := newGuardedTree(t)
+	db := tq.db
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"unscoped find", func() error {
+			var rows []*TreeNode
+			return db.Table("tree_nodes").Unscoped().Find(&rows).Error
+		}},
+		{"tenant id only", func() error {
+			var rows []*TreeNode
+			return db.Table("tree_nodes").Where("tenant_id = ?", "t1").Find(&rows).Error
+		}},
+		{"or escapes scope", func() error {
+			var rows []*TreeNode
+			return tq.scoped(db, "t1", "org").Or("1 = 1").Find(&rows).Error
+		}},
+		{"or after a newline", func() error {
+			var rows []*TreeNode
+			return db.Table("tree_nodes").
+				Where("tenant_id = ? AND tenant_type = ?\nOR 1=1", "t1", "org").
+				Find(&rows).Error
+		}},
+		{"or after a tab", func() error {
+			var rows []*TreeNode
+			return db.Table("tree_nodes").
+				Where("tenant_id = ? AND tenant_type = ?\tOR 1=1", "t1", "org").
+				Find(&rows).Error
+		}},
+		{"or between parentheses", func() error {
+			var rows []*TreeNode
+			return db.Table("tree_nodes").
+				Where("(tenant_id = ? AND tenant_type = ?)OR(1=1)", "t1", "org").
+				Find(&rows).Error
+		}},
+		{"right join", func() error {
+			var rows []map[string]interface{}
+			return db.Table("tree_node_history").Unscoped().
+				Joins("RIGHT JOIN tree_nodes ON tree_nodes.code = tree_node_history.code").
+				Select("tree_nodes.*").
+				Find(&rows).Error
+		}},
+		{"quoted join", func() error {
+			var rows []map[string]interface{}
+			return db.Table("tree_node_history").
+				Joins("LEFT JOIN `tree_nodes` ON 1 = 1").
+				Find(&rows).Error
+		}},
+		{"association join", func() error {
+			var rows []*TreeNode
+			return tq.scoped(db, "t1", "org").Joins("Parent").Find(&rows).Error
+		}},
+		{"where in subquery", func() error {
+			var rows []*TreeNode
+			return tq.scoped(db, "t1", "org").
+				Where("code IN (?)", db.Table("tree_nodes").Select("code")).
+				Find(&rows).Error
+		}},
+		{"nested subquery", func() error {
+			var rows []*TreeNode
+			return tq.scoped(db, "t1", "org").
+				Where("code IN (?)", tq.scoped(db, "t1", "org").Select("code").
+					Where("parent_id IN (?)", db.Table("tree_nodes").Select("code"))).
+				Find(&rows).Error
+		}},
+		{"table subquery", func() error {
+			var rows []map[string]interface{}
+			return db.Table("(?) AS x", db.Table("tree_nodes")).Find(&rows).Error
+		}},
+		{"raw select", func() error {
+			var rows []map[string]interface{}
+			return db.Raw("SELECT * FROM tree_nodes").Scan(&rows).Error
+		}},
+		{"raw subquery", func() error {
+			var rows []map[string]interface{}
+			return db.Raw("SELECT * FROM tree_node_history WHERE code IN (SELECT code FROM tree_nodes)").Scan(&rows).Error
+		}},
+		{"raw rows", func() error {
+			rows, err := db.Raw("SELECT COUNT(*) FROM tree_nodes").Rows()
+			if err == nil {
+				rows.Close()
+			}
+			return err
+		}},
+		{"exec", func() error {
+			return db.Exec("UPDATE tree_nodes SET name = ?", "x").Error
+		}},
+		{"unscoped update", func() error {
+			return db.Table("tree_nodes").Where("1 = 1").Update("name", "x").Error
+		}},
+		{"unscoped delete", func() error {
+			return db.Table("tree_nodes").Where("1 = 1").Delete(&TreeNode{}).Error
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, ErrTenantScopeMissing) {
+				t.Fatalf("got %v, want ErrTenantScopeMissing", err)
+			}
+		})
+	}
+
+	// Nothing was changed by the rejected writes
+	nodes, err := tq.GetDescendants(RootPath, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].Name != "a" {
+		t.Fatalf("tree changed: %+v", nodes)
+	}
+}
+
+func TestTenantGuardCrossTenant(t *testing.T) {
+	tq := newGuardedTree(t)
+
+	var rows []*TreeNode
+	if err := CrossTenant(tq.db).Table("tree_nodes").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("got %d rows, want 3", len(rows))
+	}
+
+	var joined []map[string]interface{}
+	if err := CrossTenant(tq.db).Table("tree_node_history").
+		Joins("RIGHT JOIN tree_nodes ON tree_nodes.code = tree_node_history.code").
+		Find(&joined).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var n int64
+	if err := CrossTenant(tq.db).Raw("SELECT COUNT(*) FROM tree_nodes").Scan(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("got %d, want 3", n)
+	}
+
+	if err := tq.CrossTenant().db.Exec("UPDATE tree_nodes SET position = 1").Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTenantGuardAllowsScopedQueries(t *testing.T) {
+	tq := newGuardedTree(t)
+
+	descendants, err := tq.GetDescendants(RootPath, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descendants) != 2 {
+		t.Fatalf("got %d descendants, want 2", len(descendants))
+	}
+
+	// Joins a tenant-scoped subquery of the tree table
+	leaves, err := tq.GetLeaves(RootPath, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != 1 || leaves[0].Name != "a1" {
+		t.Fatalf("got leaves %+v", leaves)
+	}
+
+	// Selects from a union of tenant-scoped subqueries
+	asOf, err := tq.GetDescendantsAsOf(RootPath, time.Now(), "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(asOf) != 2 {
+		t.Fatalf("got %d nodes as of now, want 2", len(asOf))
+	}
+
+	var rows []*TreeNode
+	if err := tq.scoped(tq.db, "t1", "org").
+		Where("code IN (?)", tq.scoped(tq.db, "t1", "org").Select("code")).
+		Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+
+	// Resolves both endpoints in subqueries
+	chain, err := tq.GetPathBetween(descendants[1].Code, descendants[0].Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("got a chain of %d nodes, want 2", len(chain))
+	}
+
+	// Raw conditions may span lines
+	if err := tq.db.Table("tree_nodes").
+		Where("tenant_id = ?\n\tAND tenant_type = ?", "t1", "org").
+		Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tq.MoveNode(descendants[1].Path, RootPath, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.DeleteNode(descendants[0].Path, "t1", "org", false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,224 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrHistoryDisabled is returned by the history methods when no history table is configured
+	ErrHistoryDisabled = errors.New("node history is not enabled")
+)
+
+type actorContextKey struct{}
+
+// ContextWithActor returns a copy of ctx carrying the actor recorded in the
+// node history for mutations run with it, e.g. a user ID
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the actor stored by ContextWithActor, or an empty string
+func ActorFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	actor, _ := ctx.Value(actorContextKey{}).(string)
+	return actor
+}
+
+// HistoryAction is the kind of change recorded in a history entry
+type HistoryAction string
+
+const (
+	// HistoryCreated records a created node
+	HistoryCreated HistoryAction = "created"
+
+	// HistoryUpdated records a change of a node's properties
+	HistoryUpdated HistoryAction = "updated"
+
+	// HistoryMoved records a node moved itself or with a moved ancestor
+	HistoryMoved HistoryAction = "moved"
+
+	// HistoryDeleted records a node deleted itself or with a deleted ancestor
+	HistoryDeleted HistoryAction = "deleted"
+)
+
+// NodeState is a snapshot of the recorded properties of a node
+type NodeState struct {
+	Name      string   `json:"name" gorm:"column:name"`
+	Path      Path     `json:"path" gorm:"column:path"`
+	ParentID  *Code    `json:"parent_id,omitempty" gorm:"column:parent_id;size:26"`
+	OwnerID   string   `json:"owner_id,omitempty" gorm:"column:owner_id"`
+	OwnerType string   `json:"owner_type,omitempty" gorm:"column:owner_type"`
+	Metadata  Metadata `json:"metadata,omitempty" gorm:"column:metadata"`
+}
+
+// nodeState returns the snapshot of node, nil for a nil node
+func nodeState(node *TreeNode) *NodeState {
+	if node == nil {
+		return nil
+	}
+
+	return &NodeState{
+		Name:      node.Name,
+		Path:      node.Path,
+		ParentID:  node.ParentID,
+		OwnerID:   node.Owner.ID,
+		OwnerType: node.Owner.Type,
+		Metadata:  node.Metadata,
+	}
+}
+
+// NodeHistory is an entry of the append-only change history of a node.
+// Moves and deletes of a subtree record an entry for every node in it.
+type NodeHistory struct {
+	// ID is a ULID. Entries are ordered by CreatedAt, with the ID breaking
+	// ties, as ULIDs only sort in write order within one process.
+	ID string `json:"id" gorm:"primarykey;size:26"`
+
+	TenantID   string `json:"tenant_id,omitempty" gorm:"column:tenant_id;index:idx_history_tenant"`
+	TenantType string `json:"tenant_type,omitempty" gorm:"column:tenant_type;index:idx_history_tenant"`
+
+	Code   Code          `json:"code" gorm:"column:code;size:26;index:idx_history_code"`
+	Action HistoryAction `json:"action" gorm:"column:action;size:16"`
+
+	// Actor is taken from the context of the mutation, see ContextWithActor
+	Actor string `json:"actor,omitempty" gorm:"column:actor"`
+
+	// Before is nil for creates, After is nil for deletes
+	Before *NodeState `json:"before,omitempty" gorm:"embedded;embeddedPrefix:before_"`
+	After  *NodeState `json:"after,omitempty" gorm:"embedded;embeddedPrefix:after_"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"index:idx_history_created_at"`
+}
+
+// AfterFind clears the snapshot a create or delete has no state for, which
+// embedded columns cannot express
+func (h *NodeHistory) AfterFind(tx *gorm.DB) error {
+	switch h.Action {
+	case HistoryCreated:
+		h.Before = nil
+	case HistoryDeleted:
+		h.After = nil
+	}
+
+	return nil
+}
+
+// MigrateHistory creates the history table configured in HistoryTableName
+func (tq *TreeQuery) MigrateHistory() error {
+	if tq.config.HistoryTableName == "" {
+		return ErrHistoryDisabled
+	}
+
+	return CrossTenant(tq.db).Table(tq.config.HistoryTableName).AutoMigrate(&NodeHistory{})
+}
+
+// historyEnabled reports whether mutations record history
+func (tq *TreeQuery) historyEnabled() bool {
+	return tq.config.HistoryTableName != ""
+}
+
+// historyEntry returns the entry of a change from before to after
+func historyEntry(action HistoryAction, tenantID, tenantType string, before, after *TreeNode) *NodeHistory {
+	entry := &NodeHistory{
+		TenantID:   tenantID,
+		TenantType: tenantType,
+		Action:     action,
+		Before:     nodeState(before),
+		After:      nodeState(after),
+	}
+
+	if after != nil {
+		entry.Code = after.Code
+	} else if before != nil {
+		entry.Code = before.Code
+	}
+
+	return entry
+}
+
+// writeHistory appends entries to the history in the current transaction,
+// recording the actor of the context. It does nothing when history is disabled.
+func (tq *TreeQuery) writeHistory(entries ...*NodeHistory) error {
+	if !tq.historyEnabled() || len(entries) == 0 {
+		return nil
+	}
+
+	actor := ActorFromContext(tq.db.Statement.Context)
+	now := time.Now()
+	for _, entry := range entries {
+		entry.ID = string(NewNodeID())
+		entry.Actor = actor
+		entry.CreatedAt = now
+	}
+
+	return tq.db.Table(tq.config.HistoryTableName).CreateInBatches(entries, 100).Error
+}
+
+// scopedHistory returns a query on the history entries of the tenant
+func (tq *TreeQuery) scopedHistory(db *gorm.DB, tenantID, tenantType string) *gorm.DB {
+	return db.Table(tq.config.HistoryTableName).
+		Scopes(tq.tenantScope(tenantID, tenantType))
+}
+
+// GetNodeHistoryQuery returns a query builder for the history of a node
+func (tq *TreeQuery) GetNodeHistoryQuery(tx *gorm.DB, code Code, tenantID, tenantType string) *gorm.DB {
+	return tq.scopedHistory(tx, tenantID, tenantType).
+		Where("code = ?", code).
+		Order("created_at, id")
+}
+
+// GetNodeHistory retrieves the history of a node, oldest entry first.
+// The history of deleted nodes remains available.
+func (tq *TreeQuery) GetNodeHistory(code Code, tenantID, tenantType string) ([]*NodeHistory, error) {
+	if !tq.historyEnabled() {
+		return nil, ErrHistoryDisabled
+	}
+
+	var entries []*NodeHistory
+	if err := tq.GetNodeHistoryQuery(tq.db, code, tenantID, tenantType).
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetSubtreeHistoryQuery returns a query builder for the history of the nodes
+// at or below path since the given time
+func (tq *TreeQuery) GetSubtreeHistoryQuery(tx *gorm.DB, path Path, since time.Time, tenantID, tenantType string) *gorm.DB {
+	query := tq.scopedHistory(tx, tenantID, tenantType)
+	if !path.IsRoot() {
+		query = query.Where(
+			"before_path = ? OR before_path LIKE ? OR after_path = ? OR after_path LIKE ?",
+			string(path), path.GetPathPrefix(), string(path), path.GetPathPrefix(),
+		)
+	}
+
+	return query.
+		Where("created_at >= ?", since).
+		Order("created_at, id")
+}
+
+// GetSubtreeHistory retrieves the history of the nodes that were at or below
+// path before or after a change, since the given time, oldest entry first.
+// Nodes moved into or out of the subtree are included.
+func (tq *TreeQuery) GetSubtreeHistory(path Path, since time.Time, tenantID, tenantType string) ([]*NodeHistory, error) {
+	if !tq.historyEnabled() {
+		return nil, ErrHistoryDisabled
+	}
+
+	var entries []*NodeHistory
+	if err := tq.GetSubtreeHistoryQuery(tq.db, path, since, tenantID, tenantType).
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,217 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newHistoryTree returns a TreeQuery recording node history
+func newHistoryTree(t *testing.T) *TreeQuery {
+	t.Helper()
+
+	config := DefaultTableConfig()
+	config.HistoryTableName = "tree_node_history"
+	return newTestTree(t, config)
+}
+
+// actions returns the actions of the entries
+func actions(entries []*NodeHistory) []HistoryAction {
+	result := make([]HistoryAction, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.Action
+	}
+	return result
+}
+
+func TestNodeHistoryRecordsEveryChange(t *testing.T) {
+	tq := newHistoryTree(t)
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+	node := mustCreate(t, tq, "node", a.Path, "t1", "org")
+
+	if err := tq.UpdateNode(node.Code, "t1", "org", map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := tq.MoveNode(node.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	moved, err := tq.GetNodeByCode(node.Code, "t1", "org")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if err := tq.DeleteNode(moved.Path, "t1", "org", false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	entries, err := tq.GetNodeHistory(node.Code, "t1", "org")
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	want := []HistoryAction{HistoryCreated, HistoryUpdated, HistoryMoved, HistoryDeleted}
+	if got := actions(entries); len(got) != len(want) {
+		t.Fatalf("actions = %v, want %v", got, want)
+	}
+	for i, entry := range entries {
+		if entry.Action != want[i] || entry.Code != node.Code || entry.TenantID != "t1" || entry.TenantType != "org" {
+			t.Fatalf("entry %d = %s %s %s/%s", i, entry.Action, entry.Code, entry.TenantID, entry.TenantType)
+		}
+	}
+
+	created, updated, movedEntry, deleted := entries[0], entries[1], entries[2], entries[3]
+
+	if created.Before != nil || created.After == nil || created.After.Name != "node" || created.After.Path != node.Path {
+		t.Fatalf("created entry = %+v -> %+v", created.Before, created.After)
+	}
+	if created.After.ParentID == nil || *created.After.ParentID != a.Code || created.After.OwnerID != "owner" {
+		t.Fatalf("created entry = %+v", created.After)
+	}
+
+	if updated.Before.Name != "node" || updated.After.Name != "renamed" || updated.After.Path != node.Path {
+		t.Fatalf("updated entry = %+v -> %+v", updated.Before, updated.After)
+	}
+
+	if movedEntry.Before.Path != node.Path || movedEntry.After.Path != moved.Path {
+		t.Fatalf("moved entry paths = %s -> %s, want %s -> %s",
+			movedEntry.Before.Path, movedEntry.After.Path, node.Path, moved.Path)
+	}
+	if *movedEntry.Before.ParentID != a.Code || *movedEntry.After.ParentID != b.Code || movedEntry.After.Name != "renamed" {
+		t.Fatalf("moved entry = %+v -> %+v", movedEntry.Before, movedEntry.After)
+	}
+
+	if deleted.After != nil || deleted.Before == nil || deleted.Before.Path != moved.Path {
+		t.Fatalf("deleted entry = %+v -> %+v", deleted.Before, deleted.After)
+	}
+
+	// The history of a deleted node stays available, and other tenants see none of it
+	other, err := tq.GetNodeHistory(node.Code, "t2", "org")
+	if err != nil {
+		t.Fatalf("history of another tenant: %v", err)
+	}
+	if len(other) != 0 {
+		t.Fatalf("another tenant sees %d entries", len(other))
+	}
+}
+
+func TestNodeHistorySubtreeMoveRecordsEveryNode(t *testing.T) {
+	tq := newHistoryTree(t)
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+	child := mustCreate(t, tq, "child", a.Path, "t1", "org")
+	grandchild := mustCreate(t, tq, "grandchild", child.Path, "t1", "org")
+
+	since := time.Now()
+	if err := tq.MoveNode(a.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+
+	entries, err := tq.GetSubtreeHistory(RootPath, since, "t1", "org")
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+
+	byCode := map[Code]*NodeHistory{}
+	for _, entry := range entries {
+		if entry.Action != HistoryMoved {
+			t.Fatalf("unexpected %s entry for %s", entry.Action, entry.Code)
+		}
+		if _, seen := byCode[entry.Code]; seen {
+			t.Fatalf("%s has more than one entry", entry.Code)
+		}
+		byCode[entry.Code] = entry
+	}
+	if len(byCode) != 3 {
+		t.Fatalf("got entries for %d nodes, want 3", len(byCode))
+	}
+
+	for _, node := range []*TreeNode{a, child, grandchild} {
+		entry := byCode[node.Code]
+		if entry == nil {
+			t.Fatalf("no entry for %s", node.Name)
+		}
+		want := b.Path + node.Path
+		if entry.Before.Path != node.Path || entry.After.Path != want {
+			t.Fatalf("%s moved %s -> %s, want %s -> %s", node.Name, entry.Before.Path, entry.After.Path, node.Path, want)
+		}
+	}
+
+	// Only the moved node changes its parent
+	if *byCode[a.Code].After.ParentID != b.Code || *byCode[child.Code].After.ParentID != a.Code {
+		t.Fatalf("parents after the move = %v, %v", *byCode[a.Code].After.ParentID, *byCode[child.Code].After.ParentID)
+	}
+}
+
+func TestNodeHistoryRecordsActorFromContext(t *testing.T) {
+	tq := newHistoryTree(t)
+
+	ctx := ContextWithActor(context.Background(), "alice")
+	node, err := tq.WithContext(ctx).CreateNode("node", RootPath, "t1", "org", "owner", "user")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := tq.UpdateNode(node.Code, "t1", "org", map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	entries, err := tq.GetNodeHistory(node.Code, "t1", "org")
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Actor != "alice" || entries[1].Actor != "" {
+		t.Fatalf("actors = %+v", entries)
+	}
+
+	if got := ActorFromContext(context.Background()); got != "" {
+		t.Fatalf("actor of an empty context = %q", got)
+	}
+}
+
+func TestSubtreeHistoryIncludesNodesMovedInAndOut(t *testing.T) {
+	tq := newHistoryTree(t)
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+	leaving := mustCreate(t, tq, "leaving", a.Path, "t1", "org")
+	arriving := mustCreate(t, tq, "arriving", b.Path, "t1", "org")
+	outside := mustCreate(t, tq, "outside", b.Path, "t1", "org")
+
+	since := time.Now()
+	if err := tq.MoveNode(leaving.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatalf("move out: %v", err)
+	}
+	if err := tq.MoveNode(arriving.Path, a.Path, "t1", "org"); err != nil {
+		t.Fatalf("move in: %v", err)
+	}
+	if err := tq.UpdateNode(outside.Code, "t1", "org", map[string]interface{}{"name": "changed"}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	entries, err := tq.GetSubtreeHistory(a.Path, since, "t1", "org")
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Code != leaving.Code || entries[1].Code != arriving.Code {
+		t.Fatalf("got %d entries, want the moves of leaving and arriving", len(entries))
+	}
+
+	// Entries before since are left out
+	entries, err = tq.GetSubtreeHistory(a.Path, time.Now().Add(time.Hour), "t1", "org")
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("got %d entries after since", len(entries))
+	}
+}
+
+func TestNodeHistoryDisabled(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	node := mustCreate(t, tq, "node", RootPath, "t1", "org")
+
+	if _, err := tq.GetNodeHistory(node.Code, "t1", "org"); !errors.Is(err, ErrHistoryDisabled) {
+		t.Fatalf("got %v, want ErrHistoryDisabled", err)
+	}
+	if _, err := tq.GetSubtreeHistory(RootPath, time.Time{}, "t1", "org"); !errors.Is(err, ErrHistoryDisabled) {
+		t.Fatalf("got %v, want ErrHistoryDisabled", err)
+	}
+}
@@ -0,0 +1,219 @@
+package materialized
+
+import (
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// CreateEvent describes a node being created
+type CreateEvent struct {
+	Tenant Tenant
+
+	// Node is the new node, with its code and path assigned
+	Node *TreeNode
+}
+
+// PathChange is the path of a node before and after a move
+type PathChange struct {
+	Code    Code
+	OldPath Path
+	NewPath Path
+}
+
+// MoveEvent describes a node being moved with its descendants
+type MoveEvent struct {
+	Tenant Tenant
+
+	// Code identifies the moved node
+	Code Code
+
+	// OldParentID and NewParentID are nil for nodes at the top level
+	OldParentID *Code
+	NewParentID *Code
+
+	// Moved lists the paths of the moved node and all its descendants, the
+	// moved node first and the rest in path order
+	Moved []PathChange
+}
+
+// DeleteEvent describes a node being deleted
+type DeleteEvent struct {
+	Tenant Tenant
+
+	// Node is the deleted node
+	Node *TreeNode
+
+	// Deleted lists the deleted node and, when descendants are deleted with it,
+	// its descendants, in path order
+	Deleted []*TreeNode
+}
+
+// UpdateEvent describes a node whose properties were updated
+type UpdateEvent struct {
+	Tenant Tenant
+
+	// Node is the node after the update
+	Node *TreeNode
+
+	// Updates holds the column updates that were applied
+	Updates map[string]interface{}
+}
+
+// CreateHook is run when a node is created. tx is the mutation's transaction.
+type CreateHook func(tx *gorm.DB, event *CreateEvent) error
+
+// MoveHook is run when a node is moved. tx is the mutation's transaction.
+type MoveHook func(tx *gorm.DB, event *MoveEvent) error
+
+// DeleteHook is run when a node is deleted. tx is the mutation's transaction.
+type DeleteHook func(tx *gorm.DB, event *DeleteEvent) error
+
+// UpdateHook is run when a node is updated. tx is the mutation's transaction.
+type UpdateHook func(tx *gorm.DB, event *UpdateEvent) error
+
+// Hooks is the registry of functions run on tree mutations.
+// Hooks run inside the mutation's transaction, so they can write related rows
+// atomically with it. An error from a before-hook vetoes the mutation, and an
+// error from any hook rolls the whole mutation back. Retried transactions run
+// their hooks again.
+type Hooks struct {
+	mu    sync.RWMutex
+	lists hookLists
+}
+
+// hookLists holds the registered hooks. Registering only appends, so a copy
+// taken under the lock stays valid while more hooks are registered.
+type hookLists struct {
+	beforeCreate []func(*gorm.DB, *CreateEvent) error
+	afterCreate  []func(*gorm.DB, *CreateEvent) error
+	beforeMove   []func(*gorm.DB, *MoveEvent) error
+	afterMove    []func(*gorm.DB, *MoveEvent) error
+	beforeDelete []func(*gorm.DB, *DeleteEvent) error
+	afterDelete  []func(*gorm.DB, *DeleteEvent) error
+	afterUpdate  []func(*gorm.DB, *UpdateEvent) error
+}
+
+// Hooks returns the hook registry of the TreeQuery. The registry is shared by
+// every TreeQuery derived from this one, e.g. with WithContext or WithTransaction.
+func (tq *TreeQuery) Hooks() *Hooks {
+	return tq.hooks
+}
+
+// BeforeCreate registers a hook run before a node is inserted.
+// It is run for every node of CreateNode, BatchCreateNodes and ImportNodes, but
+// not for the root node created implicitly by GetRootNode.
+func (h *Hooks) BeforeCreate(hook CreateHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.beforeCreate = append(h.lists.beforeCreate, hook)
+}
+
+// AfterCreate registers a hook run after a node is inserted
+func (h *Hooks) AfterCreate(hook CreateHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.afterCreate = append(h.lists.afterCreate, hook)
+}
+
+// BeforeMove registers a hook run before the paths of a moved subtree are rewritten
+func (h *Hooks) BeforeMove(hook MoveHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.beforeMove = append(h.lists.beforeMove, hook)
+}
+
+// AfterMove registers a hook run after the paths of a moved subtree are rewritten
+func (h *Hooks) AfterMove(hook MoveHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.afterMove = append(h.lists.afterMove, hook)
+}
+
+// BeforeDelete registers a hook run before a node is deleted
+func (h *Hooks) BeforeDelete(hook DeleteHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.beforeDelete = append(h.lists.beforeDelete, hook)
+}
+
+// AfterDelete registers a hook run after a node is deleted
+func (h *Hooks) AfterDelete(hook DeleteHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.afterDelete = append(h.lists.afterDelete, hook)
+}
+
+// AfterUpdate registers a hook run after a node's properties are updated
+func (h *Hooks) AfterUpdate(hook UpdateHook) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lists.afterUpdate = append(h.lists.afterUpdate, hook)
+}
+
+// registered returns the hooks registered so far, none for a nil registry
+func (h *Hooks) registered() hookLists {
+	if h == nil {
+		return hookLists{}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.lists
+}
+
+// hasMove reports whether move events need to be built
+func (h *Hooks) hasMove() bool {
+	lists := h.registered()
+	return len(lists.beforeMove) > 0 || len(lists.afterMove) > 0
+}
+
+// hasDelete reports whether delete events need to be built
+func (h *Hooks) hasDelete() bool {
+	lists := h.registered()
+	return len(lists.beforeDelete) > 0 || len(lists.afterDelete) > 0
+}
+
+// hasUpdate reports whether update events need to be built
+func (h *Hooks) hasUpdate() bool {
+	return len(h.registered().afterUpdate) > 0
+}
+
+// runHooks runs the hooks in registration order, stopping at the first error
+func runHooks[E any](tx *gorm.DB, hooks []func(*gorm.DB, E) error, event E) error {
+	for _, hook := range hooks {
+		if err := hook(tx, event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// subtreeNodes returns the node at nodePath and its descendants in path order
+func (tq *TreeQuery) subtreeNodes(nodePath Path, tenantID, tenantType string) ([]*TreeNode, error) {
+	var nodes []*TreeNode
+	if err := tq.scoped(tq.db, tenantID, tenantType).
+		Where("path = ? OR path LIKE ?", string(nodePath), nodePath.GetPathPrefix()).
+		Order("path").
+		Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// movedPaths returns the paths of the subtree at nodePath before and after
+// moving it to newPath
+func movedPaths(subtree []*TreeNode, nodePath, newPath Path) []PathChange {
+	changes := make([]PathChange, 0, len(subtree))
+	for _, node := range subtree {
+		changes = append(changes, PathChange{
+			Code:    node.Code,
+			OldPath: node.Path,
+			NewPath: newPath + node.Path[len(nodePath):],
+		})
+	}
+
+	return changes
+}
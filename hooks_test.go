@@ -0,0 +1,73 @@
+package materialized
+
+import (
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestHooksRunInOrderAndVeto(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	var calls []string
+	veto := errors.New("vetoed")
+	tq.Hooks().BeforeCreate(func(tx *gorm.DB, event *CreateEvent) error {
+		calls = append(calls, "before 1")
+		return nil
+	})
+	tq.Hooks().BeforeCreate(func(tx *gorm.DB, event *CreateEvent) error {
+		calls = append(calls, "before 2")
+		if event.Node.Name == "vetoed" {
+			return veto
+		}
+		return nil
+	})
+	tq.Hooks().AfterCreate(func(tx *gorm.DB, event *CreateEvent) error {
+		calls = append(calls, "after")
+		return nil
+	})
+
+	mustCreate(t, tq, "node", RootPath, "t1", "org")
+	if want := []string{"before 1", "before 2", "after"}; !equalStrings(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+
+	calls = nil
+	if _, err := tq.CreateNode("vetoed", RootPath, "t1", "org", "owner", "user"); !errors.Is(err, veto) {
+		t.Fatalf("got %v, want the veto", err)
+	}
+	if want := []string{"before 1", "before 2"}; !equalStrings(calls, want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+
+	var count int64
+	if err := tq.scoped(tq.db, "t1", "org").Model(&TreeNode{}).Where("name = ?", "vetoed").Count(&count).Error; err != nil {
+		t.Fatalf("count: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("vetoed node was created")
+	}
+}
+
+func TestNilHooksRunNothing(t *testing.T) {
+	var h *Hooks
+	if h.hasMove() || h.hasDelete() || h.hasUpdate() {
+		t.Fatal("nil registry reports hooks")
+	}
+	if err := runHooks(nil, h.registered().beforeCreate, &CreateEvent{}); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package materialized
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// IDGenerator generates the codes of new nodes.
+// Implementations must be safe for concurrent use and return valid ULID text,
+// see NodeID.Validate.
+type IDGenerator interface {
+	NewID() NodeID
+}
+
+// IDGeneratorFunc adapts a function to IDGenerator
+type IDGeneratorFunc func() NodeID
+
+// NewID implements IDGenerator
+func (f IDGeneratorFunc) NewID() NodeID {
+	return f()
+}
+
+// defaultIDGenerator is shared by every TreeQuery without its own generator and by NewNodeID
+var defaultIDGenerator = NewULIDGenerator(rand.New(rand.NewSource(cryptoSeed())))
+
+// DefaultIDGenerator returns the shared generator used unless WithIDGenerator is called
+func DefaultIDGenerator() IDGenerator {
+	return defaultIDGenerator
+}
+
+// cryptoSeed returns a random seed for math/rand, falling back to the clock
+func cryptoSeed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
+	}
+
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+// ULIDGenerator generates ULIDs that increase strictly across calls, including
+// calls within the same millisecond and after the clock steps back
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	entropy *ulid.MonotonicEntropy
+	now     func() time.Time
+	last    uint64
+}
+
+// NewULIDGenerator returns a monotonic ULID generator reading randomness from entropy
+func NewULIDGenerator(entropy io.Reader) *ULIDGenerator {
+	return &ULIDGenerator{
+		entropy: ulid.Monotonic(entropy, 0),
+		now:     time.Now,
+	}
+}
+
+// NewSeededIDGenerator returns a generator producing the same sequence of codes
+// for the same seed and start time, for tests and reproducible fixtures.
+// All codes carry the start time.
+func NewSeededIDGenerator(seed int64, start time.Time) *ULIDGenerator {
+	g := NewULIDGenerator(rand.New(rand.NewSource(seed)))
+	g.now = func() time.Time { return start }
+	return g
+}
+
+// NewID implements IDGenerator
+func (g *ULIDGenerator) NewID() NodeID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := ulid.Timestamp(g.now())
+	if ms < g.last {
+		ms = g.last
+	}
+
+	id, err := ulid.New(ms, g.entropy)
+	if err != nil {
+		// The entropy of this millisecond is exhausted, continue in the next one
+		ms++
+		id = ulid.MustNew(ms, g.entropy)
+	}
+	g.last = ms
+
+	return NodeID(id.String())
+}
+
+// UUIDv7Generator generates UUIDv7 values (RFC 9562). They are returned in ULID
+// text form, which has the same 48-bit millisecond prefix, so the codes remain
+// valid and sortable; ulid.Parse(string(code)) yields the 16 UUID bytes.
+type UUIDv7Generator struct{}
+
+// NewUUIDv7Generator returns a UUIDv7 generator reading randomness from crypto/rand
+func NewUUIDv7Generator() UUIDv7Generator {
+	return UUIDv7Generator{}
+}
+
+// NewID implements IDGenerator
+func (UUIDv7Generator) NewID() NodeID {
+	var id ulid.ULID
+	_ = id.SetTime(ulid.Timestamp(time.Now()))
+
+	if _, err := crand.Read(id[6:]); err != nil {
+		panic(err)
+	}
+	id[6] = id[6]&0x0f | 0x70 // version 7
+	id[8] = id[8]&0x3f | 0x80 // RFC 9562 variant
+
+	return NodeID(id.String())
+}
+
+// WithIDGenerator returns a TreeQuery creating nodes with codes from generator
+func (tq *TreeQuery) WithIDGenerator(generator IDGenerator) *TreeQuery {
+	c := tq.clone(tq.db)
+	c.idGenerator = generator
+	return c
+}
+
+// newID returns the code of a new node
+func (tq *TreeQuery) newID() NodeID {
+	if tq.idGenerator != nil {
+		return tq.idGenerator.NewID()
+	}
+
+	return defaultIDGenerator.NewID()
+}
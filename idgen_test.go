@@ -0,0 +1,119 @@
+package materialized
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestNewNodeIDConcurrentUniqueAndIncreasing(t *testing.T) {
+	const (
+		callers = 16
+		each    = 2000
+	)
+
+	ids := make([][]NodeID, callers)
+	var wg sync.WaitGroup
+	for c := 0; c < callers; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			ids[c] = make([]NodeID, each)
+			for i := range ids[c] {
+				ids[c][i] = NewNodeID()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	seen := make(map[NodeID]bool, callers*each)
+	for _, callerIDs := range ids {
+		for i, id := range callerIDs {
+			if err := id.Validate(); err != nil {
+				t.Fatalf("invalid id %s: %v", id, err)
+			}
+			if seen[id] {
+				t.Fatalf("duplicate id %s", id)
+			}
+			seen[id] = true
+
+			// Each caller sees strictly increasing IDs
+			if i > 0 && id <= callerIDs[i-1] {
+				t.Fatalf("id %s does not follow %s", id, callerIDs[i-1])
+			}
+		}
+	}
+}
+
+func TestULIDGeneratorClockStepsBack(t *testing.T) {
+	now := time.Now()
+	g := NewULIDGenerator(rand.New(rand.NewSource(1)))
+	g.now = func() time.Time { return now }
+
+	first := g.NewID()
+	now = now.Add(-time.Hour)
+	second := g.NewID()
+
+	if second <= first {
+		t.Fatalf("id %s does not follow %s after the clock stepped back", second, first)
+	}
+}
+
+func TestSeededIDGeneratorIsReproducible(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewSeededIDGenerator(42, start)
+	b := NewSeededIDGenerator(42, start)
+
+	ids := make([]NodeID, 100)
+	for i := range ids {
+		ids[i] = a.NewID()
+		if id := b.NewID(); id != ids[i] {
+			t.Fatalf("call %d: got %s and %s", i, ids[i], id)
+		}
+	}
+
+	if !sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }) {
+		t.Fatal("seeded ids are not increasing")
+	}
+}
+
+// perCallNodeID is the former NewNodeID, which seeded a new source on every call
+func perCallNodeID() NodeID {
+	entropy := ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
+	id := ulid.MustNew(ulid.Timestamp(time.Now()), entropy)
+	return NodeID(id.String())
+}
+
+func BenchmarkNewNodeID(b *testing.B) {
+	b.Run("shared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			NewNodeID()
+		}
+	})
+
+	b.Run("shared-parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				NewNodeID()
+			}
+		})
+	})
+
+	b.Run("per-call-seed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			perCallNodeID()
+		}
+	})
+
+	b.Run("per-call-seed-parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				perCallNodeID()
+			}
+		})
+	})
+}
@@ -0,0 +1,96 @@
+package materialized
+
+import (
+	"context"
+	"iter"
+)
+
+// DefaultIterBatchSize is the number of nodes IterDescendants reads per query
+const DefaultIterBatchSize = 500
+
+// IterOption configures IterDescendants
+type IterOption func(*iterOptions)
+
+type iterOptions struct {
+	breadthFirst bool
+	batchSize    int
+}
+
+// BreadthFirst iterates level by level (depth, then path) instead of depth-first (path order)
+func BreadthFirst() IterOption {
+	return func(o *iterOptions) {
+		o.breadthFirst = true
+	}
+}
+
+// BatchSize sets the number of nodes read per query
+func BatchSize(size int) IterOption {
+	return func(o *iterOptions) {
+		o.batchSize = size
+	}
+}
+
+// IterDescendants streams the descendants of a node without loading the whole
+// subtree into memory. Nodes are read in batches using keyset pagination, so no
+// connection is held between batches and concurrent inserts never cause rows to
+// be repeated. Iteration stops at the first error, which is yielded with a nil node.
+func (tq *TreeQuery) IterDescendants(
+	ctx context.Context,
+	parentPath Path,
+	tenant Tenant,
+	opts ...IterOption,
+) iter.Seq2[*TreeNode, error] {
+	o := &iterOptions{batchSize: DefaultIterBatchSize}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.batchSize <= 0 {
+		o.batchSize = DefaultIterBatchSize
+	}
+
+	keys := []string{"path"}
+	if o.breadthFirst {
+		keys = []string{depthSQL, "path"}
+	}
+
+	return func(yield func(*TreeNode, error) bool) {
+		db := tq.db.WithContext(ctx)
+
+		var last *TreeNode
+		for {
+			query := tq.GetDescendantsQuery(db, parentPath, tenant.ID, tenant.Type)
+			if last != nil {
+				query = query.Where(keysetCondition(keys, iterValues(last, o.breadthFirst), false))
+			}
+			for _, key := range keys {
+				query = query.Order(key)
+			}
+
+			var batch []*TreeNode
+			if err := query.Limit(o.batchSize).Find(&batch).Error; err != nil {
+				yield(nil, err)
+				return
+			}
+
+			for _, node := range batch {
+				if !yield(node, nil) {
+					return
+				}
+			}
+
+			if len(batch) < o.batchSize {
+				return
+			}
+			last = batch[len(batch)-1]
+		}
+	}
+}
+
+// iterValues returns the keyset values of the last node of a batch
+func iterValues(node *TreeNode, breadthFirst bool) []interface{} {
+	if breadthFirst {
+		return []interface{}{node.Path.Depth(), string(node.Path)}
+	}
+
+	return []interface{}{string(node.Path)}
+}
@@ -0,0 +1,138 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// iterFixture builds a -> (b -> (d, e), c -> f) and other in t1 and a node in
+// t2, returning a
+func iterFixture(t *testing.T, tq *TreeQuery) *TreeNode {
+	t.Helper()
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", a.Path, "t1", "org")
+	c := mustCreate(t, tq, "c", a.Path, "t1", "org")
+	mustCreate(t, tq, "d", b.Path, "t1", "org")
+	mustCreate(t, tq, "e", b.Path, "t1", "org")
+	mustCreate(t, tq, "f", c.Path, "t1", "org")
+	mustCreate(t, tq, "other", RootPath, "t1", "org")
+	mustCreate(t, tq, "g", RootPath, "t2", "org")
+
+	return a
+}
+
+func TestIterDescendantsOrder(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := iterFixture(t, tq)
+
+	tests := []struct {
+		name string
+		opts []IterOption
+		want string
+	}{
+		{"depth first", nil, "b,d,e,c,f"},
+		{"breadth first", []IterOption{BreadthFirst()}, "b,c,d,e,f"},
+	}
+	for _, tt := range tests {
+		for _, size := range []int{1, 2, 5, 0} {
+			var nodes []*TreeNode
+			for node, err := range tq.IterDescendants(context.Background(), a.Path, Tenant{"t1", "org"},
+				append(tt.opts, BatchSize(size))...) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				nodes = append(nodes, node)
+			}
+			if got := names(nodes); got != tt.want {
+				t.Fatalf("%s in batches of %d: got %s, want %s", tt.name, size, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestIterDescendantsBatches(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := iterFixture(t, tq)
+
+	// A full last batch takes one more query to find the end
+	for size, want := range map[int]int{1: 6, 2: 3, 5: 2, 6: 1} {
+		queries := countQueries(t, tq.db)
+		n := 0
+		for _, err := range tq.IterDescendants(context.Background(), a.Path, Tenant{"t1", "org"}, BatchSize(size)) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+		tq.db.Callback().Query().Remove("test:count")
+
+		if n != 5 || *queries != want {
+			t.Fatalf("batches of %d: got %d nodes in %d queries, want 5 in %d", size, n, *queries, want)
+		}
+	}
+}
+
+func TestIterDescendantsBreak(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := iterFixture(t, tq)
+
+	queries := countQueries(t, tq.db)
+	defer tq.db.Callback().Query().Remove("test:count")
+
+	var nodes []*TreeNode
+	for node, err := range tq.IterDescendants(context.Background(), a.Path, Tenant{"t1", "org"}, BatchSize(1)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+		if len(nodes) == 2 {
+			break
+		}
+	}
+
+	if got := names(nodes); got != "b,d" {
+		t.Fatalf("got %s, want b,d", got)
+	}
+	if *queries != 2 {
+		t.Fatalf("ran %d queries after the break, want 2", *queries)
+	}
+}
+
+func TestIterDescendantsCancel(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := iterFixture(t, tq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n := 0
+	for node, err := range tq.IterDescendants(ctx, a.Path, Tenant{"t1", "org"}) {
+		n++
+		if node != nil || !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, %v, want context.Canceled", node, err)
+		}
+	}
+	if n != 1 {
+		t.Fatalf("got %d results from a cancelled context, want the error", n)
+	}
+
+	// Cancelling between batches stops at the next one
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	var nodes []*TreeNode
+	var last error
+	for node, err := range tq.IterDescendants(ctx, a.Path, Tenant{"t1", "org"}, BatchSize(2)) {
+		if err != nil {
+			last = err
+			continue
+		}
+		nodes = append(nodes, node)
+		cancel()
+	}
+	if got := names(nodes); got != "b,d" || !errors.Is(last, context.Canceled) {
+		t.Fatalf("got %s and %v, want b,d and context.Canceled", got, last)
+	}
+}
@@ -0,0 +1,79 @@
+package materialized
+
+import (
+	"gorm.io/gorm"
+)
+
+// childCountRow is a node scanned together with its number of children
+type childCountRow struct {
+	TreeNode
+	Count int64 `gorm:"column:child_count"`
+}
+
+// withChildCounts adds a child_count column to a query on the tree table.
+// The counts come from one grouped subquery restricted to the nodes the query
+// selects, instead of a follow-up query per node. The query's limit, offset and
+// order are left out of the restriction, as MySQL rejects LIMIT in an IN
+// subquery; the outer query still pages.
+func (tq *TreeQuery) withChildCounts(query *gorm.DB, tenantID, tenantType string) *gorm.DB {
+	table := tq.config.TableName
+
+	parents := query.Session(&gorm.Session{}).
+		Model(&TreeNode{}).
+		Select(table + ".code")
+	delete(parents.Statement.Clauses, "LIMIT")
+	delete(parents.Statement.Clauses, "ORDER BY")
+
+	counts := tq.scoped(query.Session(&gorm.Session{NewDB: true}), tenantID, tenantType).
+		Model(&TreeNode{}).
+		Select("parent_id AS parent_code, COUNT(*) AS child_count").
+		Where("parent_id IN (?)", parents).
+		Group("parent_id")
+
+	return query.
+		Select(table+".*, COALESCE(child_counts.child_count, 0) AS child_count").
+		Joins("LEFT JOIN (?) AS child_counts ON child_counts.parent_code = "+table+".code", counts)
+}
+
+// findWithChildCounts runs a query built with withChildCounts and fills
+// ChildCount and HasChildren on the returned nodes
+func findWithChildCounts(query *gorm.DB) ([]*TreeNode, error) {
+	var rows []*childCountRow
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*TreeNode, len(rows))
+	for i, row := range rows {
+		row.TreeNode.ChildCount = row.Count
+		row.TreeNode.HasChildren = row.Count > 0
+		nodes[i] = &row.TreeNode
+	}
+
+	return nodes, nil
+}
+
+// GetLeavesQuery returns a query builder for the descendants of a node that have no children
+func (tq *TreeQuery) GetLeavesQuery(tx *gorm.DB, subtreePath Path, tenantID, tenantType string) *gorm.DB {
+	return tq.withChildCounts(tq.GetDescendantsQuery(tx, subtreePath, tenantID, tenantType), tenantID, tenantType).
+		Where("child_counts.child_count IS NULL")
+}
+
+// GetLeaves retrieves the descendants of a node that have no children, in path order
+func (tq *TreeQuery) GetLeaves(subtreePath Path, tenantID, tenantType string) ([]*TreeNode, error) {
+	return findWithChildCounts(tq.GetLeavesQuery(tq.db, subtreePath, tenantID, tenantType).
+		Order(tq.config.TableName + ".path"))
+}
+
+// GetBranchesQuery returns a query builder for the descendants of a node that have children
+func (tq *TreeQuery) GetBranchesQuery(tx *gorm.DB, subtreePath Path, tenantID, tenantType string) *gorm.DB {
+	return tq.withChildCounts(tq.GetDescendantsQuery(tx, subtreePath, tenantID, tenantType), tenantID, tenantType).
+		Where("child_counts.child_count > 0")
+}
+
+// GetBranches retrieves the descendants of a node that have children, in path
+// order, with ChildCount populated
+func (tq *TreeQuery) GetBranches(subtreePath Path, tenantID, tenantType string) ([]*TreeNode, error) {
+	return findWithChildCounts(tq.GetBranchesQuery(tq.db, subtreePath, tenantID, tenantType).
+		Order(tq.config.TableName + ".path"))
+}
@@ -0,0 +1,130 @@
+package materialized
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// leavesFixture builds a -> b1 (c1, c2), b2 (c3), b3 and returns the nodes by name
+func leavesFixture(t *testing.T, tq *TreeQuery) map[string]*TreeNode {
+	t.Helper()
+
+	nodes := map[string]*TreeNode{}
+	nodes["a"] = mustCreate(t, tq, "a", RootPath, "t1", "org")
+	for _, name := range []string{"b1", "b2", "b3"} {
+		nodes[name] = mustCreate(t, tq, name, nodes["a"].Path, "t1", "org")
+	}
+	nodes["c1"] = mustCreate(t, tq, "c1", nodes["b1"].Path, "t1", "org")
+	nodes["c2"] = mustCreate(t, tq, "c2", nodes["b1"].Path, "t1", "org")
+	nodes["c3"] = mustCreate(t, tq, "c3", nodes["b2"].Path, "t1", "org")
+
+	return nodes
+}
+
+func names(nodes []*TreeNode) string {
+	result := make([]string, len(nodes))
+	for i, node := range nodes {
+		result[i] = node.Name
+	}
+	return strings.Join(result, ",")
+}
+
+func TestGetLeavesAndBranches(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	nodes := leavesFixture(t, tq)
+
+	// Another tenant's children must not be counted
+	mustCreate(t, tq, "other", RootPath, "t2", "org")
+
+	leaves, err := tq.GetLeaves(nodes["a"].Path, "t1", "org")
+	if err != nil {
+		t.Fatalf("leaves: %v", err)
+	}
+	if got, want := names(leaves), "c1,c2,c3,b3"; got != want {
+		t.Fatalf("leaves = %s, want %s", got, want)
+	}
+	for _, leaf := range leaves {
+		if leaf.ChildCount != 0 || leaf.HasChildren {
+			t.Fatalf("leaf %s has child count %d", leaf.Name, leaf.ChildCount)
+		}
+	}
+
+	branches, err := tq.GetBranches(nodes["a"].Path, "t1", "org")
+	if err != nil {
+		t.Fatalf("branches: %v", err)
+	}
+	if got, want := names(branches), "b1,b2"; got != want {
+		t.Fatalf("branches = %s, want %s", got, want)
+	}
+	if branches[0].ChildCount != 2 || branches[1].ChildCount != 1 || !branches[0].HasChildren {
+		t.Fatalf("branch counts = %d, %d", branches[0].ChildCount, branches[1].ChildCount)
+	}
+
+	// Deleted children are not counted
+	if err := tq.DeleteNode(nodes["c3"].Path, "t1", "org", false); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	leaves, err = tq.GetLeaves(nodes["a"].Path, "t1", "org")
+	if err != nil {
+		t.Fatalf("leaves: %v", err)
+	}
+	if got, want := names(leaves), "c1,c2,b2,b3"; got != want {
+		t.Fatalf("leaves after delete = %s, want %s", got, want)
+	}
+}
+
+func TestChildCounts(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	nodes := leavesFixture(t, tq)
+	want := map[string]int64{"b1": 2, "b2": 1, "b3": 0}
+
+	children, err := tq.GetChildrenByCode(nodes["a"].Code, "t1", "org")
+	if err != nil {
+		t.Fatalf("children: %v", err)
+	}
+	if len(children) != 3 {
+		t.Fatalf("got %d children, want 3", len(children))
+	}
+	for _, child := range children {
+		if child.ChildCount != want[child.Name] || child.HasChildren != (want[child.Name] > 0) {
+			t.Fatalf("%s has child count %d, want %d", child.Name, child.ChildCount, want[child.Name])
+		}
+	}
+
+	// Paged children are counted as well
+	node, total, err := tq.GetNodeWithChildrenByCode(nodes["a"].Code, "t1", "org", 2, 1)
+	if err != nil {
+		t.Fatalf("node with children: %v", err)
+	}
+	if total != 3 || len(node.Children) != 2 {
+		t.Fatalf("got %d of %d children, want 2 of 3", len(node.Children), total)
+	}
+	for _, child := range node.Children {
+		if child.ChildCount != want[child.Name] {
+			t.Fatalf("%s has child count %d, want %d", child.Name, child.ChildCount, want[child.Name])
+		}
+	}
+}
+
+func TestChildCountsKeepLimitOutOfSubquery(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	nodes := leavesFixture(t, tq)
+
+	query, _, _, err := tq.GetNodeWithChildrenByCodeQuery(tq.db, "t1", "org", nodes["a"].Code, 2, 1)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	var rows []*childCountRow
+	stmt := tq.withChildCounts(query.Session(&gorm.Session{DryRun: true}), "t1", "org").Find(&rows).Statement
+	sql := stmt.SQL.String()
+
+	// MySQL rejects LIMIT inside an IN subquery, only the outer query may page
+	if n := strings.Count(sql, "LIMIT"); n != 1 {
+		t.Fatalf("got %d LIMIT clauses in %s", n, sql)
+	}
+	if !strings.HasSuffix(sql, "LIMIT 2 OFFSET 1") {
+		t.Fatalf("outer query is not paged: %s", sql)
+	}
+}
@@ -0,0 +1,237 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrSubtreeLocked is returned when a mutation or a lock conflicts with a
+	// subtree lock held by someone else
+	ErrSubtreeLocked = errors.New("subtree is locked")
+
+	// ErrLocksDisabled is returned by the lock methods when no lock table is configured
+	ErrLocksDisabled = errors.New("subtree locks are not enabled")
+
+	// ErrLockHolderRequired is returned when a lock is taken or released without a holder
+	ErrLockHolderRequired = errors.New("lock holder is required")
+)
+
+// SubtreeLock is a lock on a node and its descendants held for a bulk edit.
+// While it is held, other holders cannot create, update, move or delete nodes
+// in the subtree, move nodes into or out of it, restructure its ancestors, or
+// lock an overlapping subtree.
+type SubtreeLock struct {
+	ID uint `json:"id" gorm:"primarykey"`
+
+	// Tenancy fields, indexed apart from TenantFields as index names are
+	// shared between tables on some databases
+	TenantID   string `json:"tenant_id,omitempty" gorm:"column:tenant_id;index:idx_lock_tenant"`
+	TenantType string `json:"tenant_type,omitempty" gorm:"column:tenant_type;index:idx_lock_tenant"`
+
+	// Code and Path identify the locked node. The path is rewritten when the
+	// holder moves the node or one of its ancestors.
+	Code Code `json:"code" gorm:"column:code;size:26;index:idx_lock_code"`
+	Path Path `json:"path" gorm:"column:path;index:idx_lock_path"`
+
+	// Holder identifies who holds the lock, e.g. a user or session ID
+	Holder string `json:"holder" gorm:"column:holder"`
+
+	// ExpiresAt is when the lock is released automatically
+	ExpiresAt time.Time `json:"expires_at" gorm:"column:expires_at;index:idx_lock_expires_at"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WithLockHolder returns a TreeQuery whose mutations act on behalf of holder,
+// so they are not blocked by the subtree locks it holds
+func (tq *TreeQuery) WithLockHolder(holder string) *TreeQuery {
+	c := tq.clone(tq.db)
+	c.lockHolder = holder
+	return c
+}
+
+// MigrateLocks creates the lock table configured in LockTableName
+func (tq *TreeQuery) MigrateLocks() error {
+	if tq.config.LockTableName == "" {
+		return ErrLocksDisabled
+	}
+
+	return CrossTenant(tq.db).Table(tq.config.LockTableName).AutoMigrate(&SubtreeLock{})
+}
+
+// scopedLocks returns a query on the live locks of the tenant
+func (tq *TreeQuery) scopedLocks(db *gorm.DB, tenantID, tenantType string) *gorm.DB {
+	return db.Table(tq.config.LockTableName).
+		Scopes(tq.tenantScope(tenantID, tenantType)).
+		Where("expires_at > ?", time.Now())
+}
+
+// checkLocks fails with ErrSubtreeLocked if another holder has locked a subtree
+// containing path. With restructure set, locks on descendants of path conflict
+// as well, since moving or deleting the node rewrites their subtrees.
+func (tq *TreeQuery) checkLocks(path Path, tenantID, tenantType string, restructure bool) error {
+	if tq.config.LockTableName == "" {
+		return nil
+	}
+
+	query := tq.scopedLocks(tq.db, tenantID, tenantType).
+		Where("holder != ?", tq.lockHolder)
+	if restructure {
+		query = query.Where("path IN (?) OR path LIKE ?", ancestorPaths(path, 0), path.GetPathPrefix())
+	} else {
+		query = query.Where("path IN (?)", ancestorPaths(path, 0))
+	}
+
+	var locks []*SubtreeLock
+	if err := query.Limit(1).Find(&locks).Error; err != nil {
+		return err
+	}
+
+	if len(locks) > 0 {
+		return locks[0].conflict()
+	}
+
+	return nil
+}
+
+// moveLocks rewrites the paths of the locks in the subtree at nodePath after
+// it was moved to newPath, in the transaction of the move
+func (tq *TreeQuery) moveLocks(nodePath, newPath Path, tenantID, tenantType string) error {
+	if tq.config.LockTableName == "" {
+		return nil
+	}
+
+	return tq.db.Table(tq.config.LockTableName).
+		Scopes(tq.tenantScope(tenantID, tenantType)).
+		Where("path = ? OR path LIKE ?", string(nodePath), nodePath.GetPathPrefix()).
+		Update("path", gorm.Expr("CONCAT(?, SUBSTRING(path, ?))",
+			string(newPath),
+			len(string(nodePath))+1,
+		)).Error
+}
+
+// conflict returns the error reported for a mutation blocked by the lock
+func (l *SubtreeLock) conflict() error {
+	return fmt.Errorf("%w: %s held by %q until %s",
+		ErrSubtreeLocked, l.Path, l.Holder, l.ExpiresAt.Format(time.RFC3339))
+}
+
+// LockSubtree locks the node with the given code and its descendants for holder
+// until ttl has passed. Locking again as the same holder extends the lock.
+// It fails with ErrSubtreeLocked if another holder has locked the node, one of
+// its ancestors or one of its descendants.
+// The node and its ancestors are locked while the lock is taken, so concurrent
+// calls for overlapping subtrees cannot both succeed.
+func (tq *TreeQuery) LockSubtree(
+	code Code,
+	tenantID,
+	tenantType string,
+	holder string,
+	ttl time.Duration,
+) (*SubtreeLock, error) {
+	if tq.config.LockTableName == "" {
+		return nil, ErrLocksDisabled
+	}
+	if holder == "" {
+		return nil, ErrLockHolderRequired
+	}
+
+	var lock *SubtreeLock
+	err := tq.transaction(func(tq *TreeQuery) error {
+		node, err := tq.GetNodeByCode(code, tenantID, tenantType)
+		if err != nil {
+			return err
+		}
+
+		// Lock the rows from the top down, in the order moveNode locks them.
+		// Locks on overlapping subtrees share an ancestor row and are serialized.
+		var locked []*TreeNode
+		if err := forUpdate(tq.scoped(tq.db, tenantID, tenantType)).
+			Where("path IN (?)", ancestorPaths(node.Path, 0)).
+			Order("path").
+			Find(&locked).Error; err != nil {
+			return err
+		}
+
+		// Expired locks are released here, live queries already ignore them
+		if err := tq.db.Table(tq.config.LockTableName).
+			Scopes(tq.tenantScope(tenantID, tenantType)).
+			Where("expires_at <= ?", time.Now()).
+			Delete(&SubtreeLock{}).Error; err != nil {
+			return err
+		}
+
+		if err := tq.WithLockHolder(holder).checkLocks(node.Path, tenantID, tenantType, true); err != nil {
+			return err
+		}
+
+		var existing []*SubtreeLock
+		if err := tq.scopedLocks(tq.db, tenantID, tenantType).
+			Where("code = ? AND holder = ?", node.Code, holder).
+			Limit(1).
+			Find(&existing).Error; err != nil {
+			return err
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		if len(existing) > 0 {
+			lock = existing[0]
+			lock.ExpiresAt = expiresAt
+			return tq.db.Table(tq.config.LockTableName).
+				Scopes(tq.tenantScope(tenantID, tenantType)).
+				Where("id = ?", lock.ID).
+				Update("expires_at", expiresAt).Error
+		}
+
+		lock = &SubtreeLock{
+			TenantID:   tenantID,
+			TenantType: tenantType,
+			Code:       node.Code,
+			Path:       node.Path,
+			Holder:     holder,
+			ExpiresAt:  expiresAt,
+		}
+		return tq.db.Table(tq.config.LockTableName).Create(lock).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// UnlockSubtree releases the lock holder has on the node with the given code.
+// Releasing a lock that is not held is not an error.
+func (tq *TreeQuery) UnlockSubtree(code Code, tenantID, tenantType string, holder string) error {
+	if tq.config.LockTableName == "" {
+		return ErrLocksDisabled
+	}
+	if holder == "" {
+		return ErrLockHolderRequired
+	}
+
+	return tq.db.Table(tq.config.LockTableName).
+		Scopes(tq.tenantScope(tenantID, tenantType)).
+		Where("code = ? AND holder = ?", code, holder).
+		Delete(&SubtreeLock{}).Error
+}
+
+// GetSubtreeLocks retrieves the live locks of the tenant, ordered by path
+func (tq *TreeQuery) GetSubtreeLocks(tenantID, tenantType string) ([]*SubtreeLock, error) {
+	if tq.config.LockTableName == "" {
+		return nil, ErrLocksDisabled
+	}
+
+	var locks []*SubtreeLock
+	if err := tq.scopedLocks(tq.db, tenantID, tenantType).
+		Order("path").
+		Find(&locks).Error; err != nil {
+		return nil, err
+	}
+
+	return locks, nil
+}
@@ -0,0 +1,121 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newLockedTree(t *testing.T) *TreeQuery {
+	t.Helper()
+
+	config := DefaultTableConfig()
+	config.LockTableName = "tree_locks"
+	return newTestTree(t, config)
+}
+
+func TestLockFollowsMovedSubtree(t *testing.T) {
+	tq := newLockedTree(t)
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	d := mustCreate(t, tq, "d", RootPath, "t1", "org")
+	child := mustCreate(t, tq, "child", d.Path, "t1", "org")
+
+	if _, err := tq.LockSubtree(d.Code, "t1", "org", "alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.WithLockHolder("alice").MoveNode(d.Path, a.Path, "t1", "org"); err != nil {
+		t.Fatalf("move by holder: %v", err)
+	}
+
+	locks, err := tq.GetSubtreeLocks("t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	movedPath, _ := a.Path.AppendNode(d.Code)
+	if len(locks) != 1 || locks[0].Path != movedPath {
+		t.Fatalf("got locks %+v, want one at %s", locks, movedPath)
+	}
+
+	movedChild, err := tq.GetNodeByCode(child.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tq.WithLockHolder("bob").MoveNode(movedChild.Path, RootPath, "t1", "org")
+	if !errors.Is(err, ErrSubtreeLocked) {
+		t.Fatalf("move out of the locked subtree: got %v, want ErrSubtreeLocked", err)
+	}
+
+	// Moving an ancestor of the lock rewrites it as well
+	if _, err := tq.LockSubtree(a.Code, "t1", "org", "alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+	if err := tq.WithLockHolder("alice").MoveNode(a.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	movedD, err := tq.GetNodeByCode(d.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tq.WithLockHolder("bob").CreateNode("x", movedD.Path, "t1", "org", "", ""); !errors.Is(err, ErrSubtreeLocked) {
+		t.Fatalf("create in the locked subtree: got %v, want ErrSubtreeLocked", err)
+	}
+}
+
+func TestLockSubtreeRequiresHolder(t *testing.T) {
+	tq := newLockedTree(t)
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+
+	if _, err := tq.LockSubtree(a.Code, "t1", "org", "", time.Hour); !errors.Is(err, ErrLockHolderRequired) {
+		t.Fatalf("lock: got %v, want ErrLockHolderRequired", err)
+	}
+	if err := tq.UnlockSubtree(a.Code, "t1", "org", ""); !errors.Is(err, ErrLockHolderRequired) {
+		t.Fatalf("unlock: got %v, want ErrLockHolderRequired", err)
+	}
+}
+
+func TestConcurrentOverlappingLocks(t *testing.T) {
+	tq := newLockedTree(t).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 50, BaseDelay: time.Millisecond, MaxDelay: 20 * time.Millisecond})
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", a.Path, "t1", "org")
+	c := mustCreate(t, tq, "c", b.Path, "t1", "org")
+	codes := []Code{a.Code, b.Code, c.Code}
+
+	const holders = 12
+	var wg sync.WaitGroup
+	errs := make([]error, holders)
+	for i := 0; i < holders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = tq.LockSubtree(codes[i%len(codes)], "t1", "org", fmt.Sprintf("holder-%d", i), time.Hour)
+		}(i)
+	}
+	wg.Wait()
+
+	acquired := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			acquired++
+		case !errors.Is(err, ErrSubtreeLocked):
+			t.Errorf("lock: %v", err)
+		}
+	}
+	if acquired != 1 {
+		t.Fatalf("%d holders acquired overlapping locks, want 1", acquired)
+	}
+
+	locks, err := tq.GetSubtreeLocks("t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locks) != 1 {
+		t.Fatalf("got %d locks, want 1", len(locks))
+	}
+}
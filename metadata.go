@@ -0,0 +1,88 @@
+package materialized
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Metadata holds arbitrary key-value data stored with a node as JSON
+type Metadata map[string]interface{}
+
+// Value implements driver.Valuer
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+// Scan implements sql.Scanner
+func (m *Metadata) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Metadata", value)
+	}
+
+	if len(data) == 0 {
+		*m = nil
+		return nil
+	}
+
+	return json.Unmarshal(data, m)
+}
+
+// GormDataType implements schema.GormDataTypeInterface
+func (Metadata) GormDataType() string {
+	return "json"
+}
+
+// GormDBDataType stores metadata in the database's JSON type where there is one
+func (Metadata) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return "jsonb"
+	case "mysql":
+		return "json"
+	}
+
+	return "text"
+}
+
+// metadataValueSQL returns the SQL extracting the string value of a metadata key
+// for the database's dialect. The JSON path is bound as a parameter.
+func metadataValueSQL(db *gorm.DB, key string) (string, interface{}) {
+	switch db.Dialector.Name() {
+	case "postgres":
+		return "metadata ->> ?", key
+	case "mysql":
+		return "JSON_UNQUOTE(JSON_EXTRACT(metadata, ?))", metadataPath(key)
+	case "sqlserver":
+		return "JSON_VALUE(metadata, ?)", metadataPath(key)
+	}
+
+	return "json_extract(metadata, ?)", metadataPath(key)
+}
+
+// metadataPath returns the JSON path of a top-level key
+func metadataPath(key string) string {
+	quoted, _ := json.Marshal(key)
+	return "$." + string(quoted)
+}
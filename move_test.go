@@ -0,0 +1,35 @@
+package materialized
+
+import "testing"
+
+func TestMoveNodeSetsParentID(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", a.Path, "t1", "org")
+	c := mustCreate(t, tq, "c", RootPath, "t1", "org")
+
+	// Under a node below the top level
+	if err := tq.MoveNode(c.Path, b.Path, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err := tq.GetNodeByCode(c.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ParentID == nil || *moved.ParentID != b.Code {
+		t.Fatalf("got parent_id %v, want %s", moved.ParentID, b.Code)
+	}
+
+	// Back to the top level
+	if err := tq.MoveNode(moved.Path, RootPath, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	moved, err = tq.GetNodeByCode(c.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.ParentID != nil {
+		t.Fatalf("got parent_id %s, want nil at the top level", *moved.ParentID)
+	}
+}
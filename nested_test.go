@@ -0,0 +1,58 @@
+package materialized
+
+import "testing"
+
+func TestGetSubtreeNestedVirtualRoot(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	a1 := mustCreate(t, tq, "a1", a.Path, "t1", "org")
+	mustCreate(t, tq, "a1x", a1.Path, "t1", "org")
+	mustCreate(t, tq, "b", RootPath, "t1", "org")
+	mustCreate(t, tq, "other", RootPath, "t2", "org")
+
+	root, err := tq.GetSubtreeNested(RootPath, "t1", "org", 0)
+	if err != nil {
+		t.Fatalf("nested without a root row: %v", err)
+	}
+	if root.Path != RootPath || root.ID != 0 {
+		t.Fatalf("got root %s with ID %d, want a virtual root", root.Path, root.ID)
+	}
+	if len(root.Children) != 2 || root.Children[0].Name != "a" || root.Children[1].Name != "b" {
+		t.Fatalf("got top-level nodes %+v", root.Children)
+	}
+	if len(root.Children[0].Children) != 1 || len(root.Children[0].Children[0].Children) != 1 {
+		t.Fatal("descendants of a are not nested")
+	}
+
+	// The depth limit applies below the virtual root
+	root, err = tq.GetSubtreeNested(RootPath, "t1", "org", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root.Children) != 2 || len(root.Children[0].Children) != 0 || !root.Children[0].HasMoreChildren {
+		t.Fatalf("got %+v, want the top level with a marked as having more", root.Children)
+	}
+
+	// A subtree still needs its node
+	if _, err := tq.GetSubtreeNested("/missing", "t1", "org", 0); err != ErrUnauthorized {
+		t.Fatalf("got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestGetSubtreeNestedRootRow(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	if _, err := tq.GetRootNode("t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, tq, "a", RootPath, "t1", "org")
+
+	root, err := tq.GetSubtreeNested(RootPath, "t1", "org", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.ID == 0 || root.Name != "root" || len(root.Children) != 1 {
+		t.Fatalf("got root %+v, want the root row with one child", root)
+	}
+}
@@ -1,7 +1,6 @@
 package materialized
 
 import (
-	"math/rand"
 	"strings"
 	"time"
 
@@ -26,11 +25,10 @@ func (nids NodeIDs) ToPath() Path {
 	return Path(string(RootPath) + strings.Join(strs, PathSeparator))
 }
 
-// NewNodeID generates a new ULID-based NodeID
+// NewNodeID generates a new ULID-based NodeID with the shared default generator.
+// IDs increase strictly across calls, also within the same millisecond.
 func NewNodeID() NodeID {
-	entropy := ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0)
-	id := ulid.MustNew(ulid.Timestamp(time.Now()), entropy)
-	return NodeID(id.String())
+	return defaultIDGenerator.NewID()
 }
 
 // Validate checks if the NodeID is a valid ULID
@@ -39,6 +37,32 @@ func (nid NodeID) Validate() error {
 	return err
 }
 
+// Time returns the creation time embedded in the NodeID, with millisecond precision
+func (nid NodeID) Time() (time.Time, error) {
+	id, err := ulid.Parse(string(nid))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return ulid.Time(id.Time()), nil
+}
+
+// minNodeIDAt returns the smallest NodeID generated at t. Codes generated at or
+// after t sort at or after it, codes generated before t sort before it.
+// Times outside the ULID range are clamped.
+func minNodeIDAt(t time.Time) NodeID {
+	var id ulid.ULID
+	switch {
+	case t.Before(time.UnixMilli(0)):
+	case t.After(ulid.Time(ulid.MaxTime())):
+		_ = id.SetTime(ulid.MaxTime())
+	default:
+		_ = id.SetTime(ulid.Timestamp(t))
+	}
+
+	return NodeID(id.String())
+}
+
 func Validate(nid NodeID) error {
 	return nid.Validate()
 }
@@ -0,0 +1,76 @@
+package materialized
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// nodeIDAt returns the NodeID of time t with every entropy byte set to b
+func nodeIDAt(t *testing.T, at time.Time, b byte) NodeID {
+	t.Helper()
+
+	var id ulid.ULID
+	if err := id.SetTime(ulid.Timestamp(at)); err != nil {
+		t.Fatal(err)
+	}
+	if err := id.SetEntropy(bytes.Repeat([]byte{b}, 10)); err != nil {
+		t.Fatal(err)
+	}
+	return NodeID(id.String())
+}
+
+func TestNodeIDTime(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC).Add(1500 * time.Microsecond)
+
+	id := NewSeededIDGenerator(1, at).NewID()
+	got, err := id.Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := at.Truncate(time.Millisecond); !got.Equal(want) {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+
+	if _, err := NodeID("not a ulid").Time(); err == nil {
+		t.Fatal("got no error for an invalid id")
+	}
+}
+
+func TestMinNodeIDAt(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		id     NodeID
+		before bool
+	}{
+		{"last id of the previous millisecond", nodeIDAt(t, at.Add(-time.Millisecond), 0xff), true},
+		{"first id of the millisecond", nodeIDAt(t, at, 0x00), false},
+		{"last id of the millisecond", nodeIDAt(t, at, 0xff), false},
+		{"first id of the next millisecond", nodeIDAt(t, at.Add(time.Millisecond), 0x00), false},
+	}
+	for _, tt := range tests {
+		// Within a millisecond the bound is the same
+		for _, offset := range []time.Duration{0, 999 * time.Microsecond} {
+			min := minNodeIDAt(at.Add(offset))
+			if before := tt.id < min; before != tt.before {
+				t.Fatalf("%s at +%s: %s < %s is %v, want %v", tt.name, offset, tt.id, min, before, tt.before)
+			}
+		}
+	}
+
+	if got, err := minNodeIDAt(at).Time(); err != nil || !got.Equal(at) {
+		t.Fatalf("got %s, %v, want %s", got, err, at)
+	}
+
+	// Times outside the ULID range are clamped
+	if got := minNodeIDAt(time.UnixMilli(-1)); got != "00000000000000000000000000" {
+		t.Fatalf("got %s before the epoch", got)
+	}
+	if got := minNodeIDAt(ulid.Time(ulid.MaxTime()).Add(time.Hour)); got != "7ZZZZZZZZZ0000000000000000" {
+		t.Fatalf("got %s after the last ULID time", got)
+	}
+}
@@ -0,0 +1,290 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrOutboxDisabled is returned by the outbox methods when no outbox table is configured
+	ErrOutboxDisabled = errors.New("outbox is not enabled")
+)
+
+// EventType is the type of a tree change event
+type EventType string
+
+const (
+	// EventNodeCreated is written for every node created, including the root
+	// node created by GetRootNode
+	EventNodeCreated EventType = "NodeCreated"
+
+	// EventNodeUpdated is written when a node's properties are updated
+	EventNodeUpdated EventType = "NodeUpdated"
+
+	// EventSubtreeMoved is written when a node is moved with its descendants.
+	// The paths of the descendants change by the same prefix as the node's.
+	EventSubtreeMoved EventType = "SubtreeMoved"
+
+	// EventNodeDeleted is written when a node without descendants is deleted
+	EventNodeDeleted EventType = "NodeDeleted"
+
+	// EventSubtreeDeleted is written when a node is deleted with its descendants
+	EventSubtreeDeleted EventType = "SubtreeDeleted"
+)
+
+// OutboxEvent is a tree change written to the outbox table in the transaction
+// of the change, for delivery to other services by a Relay
+type OutboxEvent struct {
+	// ID is a ULID, so events sort in the order they were written
+	ID string `json:"id" gorm:"primarykey;size:26"`
+
+	Type EventType `json:"type" gorm:"column:type;size:32"`
+
+	TenantID   string `json:"tenant_id,omitempty" gorm:"column:tenant_id;index:idx_outbox_tenant"`
+	TenantType string `json:"tenant_type,omitempty" gorm:"column:tenant_type;index:idx_outbox_tenant"`
+
+	// Code identifies the changed node
+	Code Code `json:"code" gorm:"column:code;size:26"`
+
+	// ParentID and Path are the node's parent and path after the change, empty
+	// for deletes. OldParentID and OldPath are the ones before a move or delete.
+	ParentID    *Code `json:"parent_id,omitempty" gorm:"column:parent_id;size:26"`
+	Path        Path  `json:"path,omitempty" gorm:"column:path"`
+	OldParentID *Code `json:"old_parent_id,omitempty" gorm:"column:old_parent_id;size:26"`
+	OldPath     Path  `json:"old_path,omitempty" gorm:"column:old_path"`
+
+	CreatedAt time.Time `json:"created_at"`
+
+	// DispatchedAt is set once a Relay has published the event
+	DispatchedAt *time.Time `json:"dispatched_at,omitempty" gorm:"column:dispatched_at;index:idx_outbox_dispatched"`
+
+	// ClaimedUntil reserves the event for the Relay publishing it
+	ClaimedUntil *time.Time `json:"-" gorm:"column:claimed_until"`
+}
+
+// MigrateOutbox creates the outbox table configured in OutboxTableName
+func (tq *TreeQuery) MigrateOutbox() error {
+	if tq.config.OutboxTableName == "" {
+		return ErrOutboxDisabled
+	}
+
+	return CrossTenant(tq.db).Table(tq.config.OutboxTableName).AutoMigrate(&OutboxEvent{})
+}
+
+// writeOutbox inserts events into the outbox in the current transaction.
+// It does nothing when the outbox is disabled.
+func (tq *TreeQuery) writeOutbox(events ...*OutboxEvent) error {
+	if tq.config.OutboxTableName == "" || len(events) == 0 {
+		return nil
+	}
+
+	for _, event := range events {
+		event.ID = string(NewNodeID())
+	}
+
+	return tq.db.Table(tq.config.OutboxTableName).CreateInBatches(events, 100).Error
+}
+
+// nodeEvent returns the event of a created or updated node
+func nodeEvent(eventType EventType, node *TreeNode) *OutboxEvent {
+	return &OutboxEvent{
+		Type:       eventType,
+		TenantID:   node.Tenant.ID,
+		TenantType: node.Tenant.Type,
+		Code:       node.Code,
+		ParentID:   node.ParentID,
+		Path:       node.Path,
+	}
+}
+
+// Publisher delivers an outbox event to its consumers. Delivery is at least
+// once: an event is published again if the Relay fails before recording it
+// as dispatched, so consumers should deduplicate by ID.
+type Publisher func(ctx context.Context, event *OutboxEvent) error
+
+// Default settings of a Relay, also used in place of zero values
+const (
+	defaultRelayBatchSize    = 100
+	defaultRelayInterval     = time.Second
+	defaultRelayClaimTimeout = 30 * time.Second
+)
+
+// Relay polls the outbox table and publishes undispatched events in order
+type Relay struct {
+	tq      *TreeQuery
+	publish Publisher
+
+	// BatchSize is the number of events claimed per poll
+	BatchSize int
+
+	// Interval is the pause between polls once the outbox is drained or
+	// publishing failed
+	Interval time.Duration
+
+	// ClaimTimeout is how long a claimed batch is reserved for publishing.
+	// Events claimed by a relay that stopped are claimed again after it.
+	ClaimTimeout time.Duration
+}
+
+// NewRelay returns a Relay publishing the outbox events of tq with publish
+func (tq *TreeQuery) NewRelay(publish Publisher) *Relay {
+	return &Relay{
+		tq:           tq,
+		publish:      publish,
+		BatchSize:    defaultRelayBatchSize,
+		Interval:     defaultRelayInterval,
+		ClaimTimeout: defaultRelayClaimTimeout,
+	}
+}
+
+// batchSize returns BatchSize, or the default when it is not positive
+func (r *Relay) batchSize() int {
+	if r.BatchSize <= 0 {
+		return defaultRelayBatchSize
+	}
+
+	return r.BatchSize
+}
+
+// interval returns Interval, or the default when it is not positive
+func (r *Relay) interval() time.Duration {
+	if r.Interval <= 0 {
+		return defaultRelayInterval
+	}
+
+	return r.Interval
+}
+
+// claimTimeout returns ClaimTimeout, or the default when it is not positive
+func (r *Relay) claimTimeout() time.Duration {
+	if r.ClaimTimeout <= 0 {
+		return defaultRelayClaimTimeout
+	}
+
+	return r.ClaimTimeout
+}
+
+// Run publishes events until ctx is done, then returns the context's error.
+// Publishing errors are retried on the next poll.
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.Dispatch(ctx)
+		if err == nil && n == r.batchSize() {
+			// More events may be waiting
+			continue
+		}
+
+		timer := time.NewTimer(r.interval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Dispatch publishes one batch of undispatched events and marks them
+// dispatched. The batch is claimed in a short transaction first, so no locks
+// are held while publishing and several relays can run side by side; on
+// databases supporting SKIP LOCKED they claim disjoint batches concurrently.
+// Publishing stops at the first failing event: the events published before it
+// are marked, the rest are released for the next poll.
+// It returns the number of events published.
+func (r *Relay) Dispatch(ctx context.Context) (int, error) {
+	if r.tq.config.OutboxTableName == "" {
+		return 0, ErrOutboxDisabled
+	}
+
+	events, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	published := make([]string, 0, len(events))
+	var publishErr error
+	for _, event := range events {
+		if publishErr = r.publish(ctx, event); publishErr != nil {
+			break
+		}
+		published = append(published, event.ID)
+	}
+
+	// Marks are written even when ctx was canceled while publishing, as the
+	// events were delivered
+	db := r.tq.db.WithContext(context.WithoutCancel(ctx))
+	if len(published) > 0 {
+		if err := db.Table(r.tq.config.OutboxTableName).
+			Where("id IN (?)", published).
+			Updates(map[string]interface{}{"dispatched_at": time.Now(), "claimed_until": nil}).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	if len(published) < len(events) {
+		released := make([]string, 0, len(events)-len(published))
+		for _, event := range events[len(published):] {
+			released = append(released, event.ID)
+		}
+		if err := db.Table(r.tq.config.OutboxTableName).
+			Where("id IN (?)", released).
+			Update("claimed_until", nil).Error; err != nil {
+			return len(published), err
+		}
+	}
+
+	return len(published), publishErr
+}
+
+// claim reserves the next batch of undispatched events that are not claimed
+// by another relay and returns them in order
+func (r *Relay) claim(ctx context.Context) ([]*OutboxEvent, error) {
+	var events []*OutboxEvent
+	err := r.tq.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		query := tx.Table(r.tq.config.OutboxTableName).
+			Where("dispatched_at IS NULL AND (claimed_until IS NULL OR claimed_until < ?)", now).
+			Order("id").
+			Limit(r.batchSize())
+		switch tx.Dialector.Name() {
+		case "postgres", "mysql":
+			query = query.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"})
+		}
+
+		if err := query.Find(&events).Error; err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		ids := make([]string, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+
+		return tx.Table(r.tq.config.OutboxTableName).
+			Where("id IN (?)", ids).
+			Update("claimed_until", now.Add(r.claimTimeout())).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Purge deletes events dispatched before the given time
+func (r *Relay) Purge(ctx context.Context, before time.Time) error {
+	if r.tq.config.OutboxTableName == "" {
+		return ErrOutboxDisabled
+	}
+
+	return r.tq.db.WithContext(ctx).Table(r.tq.config.OutboxTableName).
+		Where("dispatched_at < ?", before).
+		Delete(&OutboxEvent{}).Error
+}
@@ -0,0 +1,157 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newOutboxTree(t *testing.T) *TreeQuery {
+	t.Helper()
+
+	config := DefaultTableConfig()
+	config.OutboxTableName = "tree_outbox"
+	return newTestTree(t, config)
+}
+
+func TestRelayPublishesOutsideTheClaimTransaction(t *testing.T) {
+	tq := newOutboxTree(t)
+	mustCreate(t, tq, "a", RootPath, "t1", "org")
+	mustCreate(t, tq, "b", RootPath, "t1", "org")
+
+	var published []EventType
+	relay := tq.NewRelay(func(ctx context.Context, event *OutboxEvent) error {
+		// The claim is committed and visible to other connections
+		var claimed int64
+		if err := tq.db.Table("tree_outbox").
+			Where("id = ? AND claimed_until IS NOT NULL", event.ID).
+			Count(&claimed).Error; err != nil {
+			return err
+		}
+		if claimed != 1 {
+			t.Errorf("event %s is published before its claim is committed", event.ID)
+		}
+
+		published = append(published, event.Type)
+		return nil
+	})
+
+	n, err := relay.Dispatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 || len(published) != 2 {
+		t.Fatalf("published %d events, want 2", n)
+	}
+
+	var pending int64
+	if err := tq.db.Table("tree_outbox").Where("dispatched_at IS NULL").Count(&pending).Error; err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Fatalf("%d events are not marked dispatched", pending)
+	}
+}
+
+func TestRelayReleasesEventsAfterPublishError(t *testing.T) {
+	tq := newOutboxTree(t)
+	for _, name := range []string{"a", "b", "c"} {
+		mustCreate(t, tq, name, RootPath, "t1", "org")
+	}
+
+	failed := errors.New("broker down")
+	calls := 0
+	relay := tq.NewRelay(func(ctx context.Context, event *OutboxEvent) error {
+		calls++
+		if calls == 2 {
+			return failed
+		}
+		return nil
+	})
+
+	n, err := relay.Dispatch(context.Background())
+	if !errors.Is(err, failed) || n != 1 {
+		t.Fatalf("got %d, %v, want 1 published and the publish error", n, err)
+	}
+
+	// The failed and the remaining events are published by the next poll
+	n, err = relay.Dispatch(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("got %d, %v, want the other 2 events", n, err)
+	}
+}
+
+func TestRelaySkipsEventsClaimedByAnotherRelay(t *testing.T) {
+	tq := newOutboxTree(t)
+	mustCreate(t, tq, "a", RootPath, "t1", "org")
+	mustCreate(t, tq, "b", RootPath, "t1", "org")
+
+	var first OutboxEvent
+	if err := tq.db.Table("tree_outbox").Order("id").First(&first).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.db.Table("tree_outbox").Where("id = ?", first.ID).
+		Update("claimed_until", time.Now().Add(time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var published []string
+	relay := tq.NewRelay(func(ctx context.Context, event *OutboxEvent) error {
+		published = append(published, event.ID)
+		return nil
+	})
+	if _, err := relay.Dispatch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != 1 || published[0] == first.ID {
+		t.Fatalf("published %v, want only the unclaimed event", published)
+	}
+
+	// An expired claim is taken over
+	if err := tq.db.Table("tree_outbox").Where("id = ?", first.ID).
+		Update("claimed_until", time.Now().Add(-time.Second)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n, err := relay.Dispatch(context.Background()); err != nil || n != 1 {
+		t.Fatalf("got %d, %v, want the expired claim published", n, err)
+	}
+}
+
+func TestRelayZeroSettingsDoNotSpin(t *testing.T) {
+	tq := newOutboxTree(t)
+	relay := tq.NewRelay(func(ctx context.Context, event *OutboxEvent) error { return nil })
+	relay.BatchSize = 0
+	relay.Interval = 0
+
+	queries := countQueries(t, tq.db)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := relay.Run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want the context error", err)
+	}
+	if *queries > 2 {
+		t.Fatalf("an idle relay polled %d times in 100ms", *queries)
+	}
+}
+
+func TestGetRootNodeWritesCreatedEvent(t *testing.T) {
+	tq := newOutboxTree(t)
+
+	root, err := tq.GetRootNode("t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tq.GetRootNode("t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []*OutboxEvent
+	if err := tq.db.Table("tree_outbox").Find(&events).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EventNodeCreated || events[0].Path != root.Path {
+		t.Fatalf("got events %+v, want one NodeCreated for the root", events)
+	}
+}
@@ -127,7 +127,8 @@ func (p Path) GetNodeIDs() NodeIDs {
 	}
 
 	// Split path by separator and convert each part to NodeID
-	parts := strings.Split(strings.TrimSuffix(string(p), PathSeparator), PathSeparator)
+	trimmed := strings.TrimPrefix(strings.TrimSuffix(string(p), PathSeparator), PathSeparator)
+	parts := strings.Split(trimmed, PathSeparator)
 	nodeIDs := make(NodeIDs, len(parts))
 	for i, part := range parts {
 		nodeIDs[i] = NodeID(part)
@@ -205,3 +206,33 @@ func ValidatePath(path string) error {
 
 	return nil
 }
+
+// CommonAncestor returns the path of the lowest common ancestor of the given paths.
+// A path counts as its own ancestor, so the common ancestor of a node and one of
+// its descendants is the node itself. It returns the root path when the paths
+// share no node or none are given.
+func CommonAncestor(paths ...Path) Path {
+	if len(paths) == 0 {
+		return RootPath
+	}
+
+	common := paths[0].GetNodeIDs()
+	for _, p := range paths[1:] {
+		ids := p.GetNodeIDs()
+
+		n := 0
+		for n < len(common) && n < len(ids) && common[n] == ids[n] {
+			n++
+		}
+		common = common[:n]
+	}
+
+	return common.ToPath()
+}
+
+// Distance returns the number of edges between two nodes, going up from a to
+// their lowest common ancestor and down to b
+func Distance(a, b Path) int {
+	ancestor := CommonAncestor(a, b)
+	return a.Depth() + b.Depth() - 2*ancestor.Depth()
+}
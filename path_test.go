@@ -0,0 +1,43 @@
+package materialized
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPathGetNodeIDs(t *testing.T) {
+	tests := []struct {
+		path Path
+		want NodeIDs
+	}{
+		{RootPath, NodeIDs{}},
+		{"/a", NodeIDs{"a"}},
+		{"/a/b", NodeIDs{"a", "b"}},
+		{"/a/b/c", NodeIDs{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.path.GetNodeIDs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathGetAncestorAtDepth(t *testing.T) {
+	path := Path("/a/b/c")
+	want := []Path{RootPath, "/a", "/a/b", "/a/b/c"}
+
+	for depth, w := range want {
+		got, err := path.GetAncestorAtDepth(depth)
+		if err != nil {
+			t.Fatalf("depth %d: %v", depth, err)
+		}
+		if got != w {
+			t.Errorf("depth %d: got %s, want %s", depth, got, w)
+		}
+	}
+
+	if _, err := path.GetAncestorAtDepth(4); err == nil {
+		t.Error("depth 4: want an error")
+	}
+}
@@ -0,0 +1,385 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// PatternAny matches exactly one path segment
+	PatternAny = "*"
+
+	// PatternAnyDepth matches any number of path segments, including none
+	PatternAnyDepth = "**"
+
+	// PatternAlternative separates the alternatives of a segment, e.g. A|B
+	PatternAlternative = "|"
+
+	// PatternName prefixes an alternative matching node names instead of codes,
+	// e.g. name:Team
+	PatternName = "name:"
+)
+
+var (
+	// ErrInvalidPattern is returned when a path pattern cannot be parsed
+	ErrInvalidPattern = errors.New("invalid path pattern")
+)
+
+// patternSegment is one segment of a path pattern
+type patternSegment struct {
+	any          bool
+	anyDepth     bool
+	alternatives []NodeID
+	names        []string
+}
+
+// matches reports whether a single node ID matches the segment, looking up
+// node names in names
+func (s patternSegment) matches(id NodeID, names map[Code]string) bool {
+	if s.any {
+		return true
+	}
+
+	for _, alternative := range s.alternatives {
+		if alternative == id {
+			return true
+		}
+	}
+
+	if name, ok := names[id]; ok {
+		for _, alternative := range s.names {
+			if alternative == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// literal reports whether the segment matches exactly one known code
+func (s patternSegment) literal() bool {
+	return !s.any && !s.anyDepth && len(s.alternatives) == 1 && len(s.names) == 0
+}
+
+// PathPattern is a parsed pattern over the nodes of a path.
+// Segments are separated by "/" and matched from the root: a segment is a node
+// code, a node name prefixed with "name:", alternatives of those such as A|B,
+// "*" for exactly one node or "**" for any number of nodes. For example A/*/B
+// matches B two levels below the root-level node A, **/B matches B anywhere and
+// A/**/name:Team matches the nodes named Team below A.
+//
+// Names cannot contain "/" or "|". Paths hold codes only, so patterns with name
+// segments are matched with MatchNames.
+type PathPattern struct {
+	source   string
+	segments []patternSegment
+}
+
+// ParsePathPattern parses a path pattern. A leading "/" is optional.
+func ParsePathPattern(pattern string) (*PathPattern, error) {
+	pp := &PathPattern{source: pattern}
+
+	trimmed := strings.TrimPrefix(pattern, PathSeparator)
+	if trimmed == "" {
+		return pp, nil
+	}
+
+	for _, part := range strings.Split(trimmed, PathSeparator) {
+		switch part {
+		case "":
+			return nil, fmt.Errorf("%w: empty segment in %q", ErrInvalidPattern, pattern)
+		case PatternAny:
+			pp.segments = append(pp.segments, patternSegment{any: true})
+		case PatternAnyDepth:
+			// Consecutive ** are equivalent to one
+			if n := len(pp.segments); n > 0 && pp.segments[n-1].anyDepth {
+				continue
+			}
+			pp.segments = append(pp.segments, patternSegment{anyDepth: true})
+		default:
+			var segment patternSegment
+			for _, alternative := range strings.Split(part, PatternAlternative) {
+				name, isName := strings.CutPrefix(alternative, PatternName)
+				if isName {
+					if name == "" {
+						return nil, fmt.Errorf("%w: empty name in %q", ErrInvalidPattern, pattern)
+					}
+					segment.names = append(segment.names, name)
+					continue
+				}
+				if alternative == "" || strings.Contains(alternative, PatternAny) {
+					return nil, fmt.Errorf("%w: invalid segment %q in %q", ErrInvalidPattern, part, pattern)
+				}
+				segment.alternatives = append(segment.alternatives, NodeID(alternative))
+			}
+			pp.segments = append(pp.segments, segment)
+		}
+	}
+
+	return pp, nil
+}
+
+// MustParsePathPattern is like ParsePathPattern but panics on an invalid pattern
+func MustParsePathPattern(pattern string) *PathPattern {
+	pp, err := ParsePathPattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	return pp
+}
+
+// String returns the pattern as it was parsed
+func (pp *PathPattern) String() string {
+	return pp.source
+}
+
+// Match reports whether the path matches the pattern. Name alternatives never
+// match, as a path does not hold the names of its nodes; use MatchNames for
+// patterns with names.
+func (pp *PathPattern) Match(p Path) bool {
+	return pp.match(p.GetNodeIDs(), nil, 0)
+}
+
+// MatchNames reports whether the path matches the pattern, with names holding
+// the names of the nodes on the path by code
+func (pp *PathPattern) MatchNames(p Path, names map[Code]string) bool {
+	return pp.match(p.GetNodeIDs(), names, 0)
+}
+
+// usesNames reports whether any segment matches node names, and whether any
+// but the last does, needing the names of ancestors
+func (pp *PathPattern) usesNames() (names, ancestors bool) {
+	for i, segment := range pp.segments {
+		if len(segment.names) > 0 {
+			names = true
+			ancestors = ancestors || i < len(pp.segments)-1
+		}
+	}
+
+	return names, ancestors
+}
+
+// MatchPattern reports whether the path matches the pattern
+func (p Path) MatchPattern(pp *PathPattern) bool {
+	return pp.Match(p)
+}
+
+// match matches ids against the segments from index i
+func (pp *PathPattern) match(ids NodeIDs, names map[Code]string, i int) bool {
+	for ; i < len(pp.segments); i++ {
+		segment := pp.segments[i]
+		if segment.anyDepth {
+			// Try every split, leaving the rest to the remaining segments
+			for skip := 0; skip <= len(ids); skip++ {
+				if pp.match(ids[skip:], names, i+1) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(ids) == 0 || !segment.matches(ids[0], names) {
+			return false
+		}
+		ids = ids[1:]
+	}
+
+	return len(ids) == 0
+}
+
+// literalPrefix returns the path made of the leading single node IDs of the pattern
+func (pp *PathPattern) literalPrefix() NodeIDs {
+	var prefix NodeIDs
+	for _, segment := range pp.segments {
+		if !segment.literal() {
+			break
+		}
+		prefix = append(prefix, segment.alternatives[0])
+	}
+
+	return prefix
+}
+
+// depthRange returns the depths of the paths the pattern can match.
+// maxDepth is -1 when the pattern contains ** and has no upper bound.
+func (pp *PathPattern) depthRange() (minDepth, maxDepth int) {
+	for _, segment := range pp.segments {
+		if segment.anyDepth {
+			maxDepth = -1
+			continue
+		}
+		minDepth++
+	}
+
+	if maxDepth == 0 {
+		maxDepth = minDepth
+	}
+
+	return minDepth, maxDepth
+}
+
+// regexp returns a POSIX regular expression matching the paths the pattern matches
+func (pp *PathPattern) regexp() string {
+	if minDepth, _ := pp.depthRange(); minDepth == 0 {
+		// Patterns that can match the root would need "/" as a special case
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, segment := range pp.segments {
+		switch {
+		case segment.anyDepth:
+			sb.WriteString("(/[^/]+)*")
+		case segment.any || len(segment.names) > 0:
+			// Names are not in the path, such segments match any code
+			sb.WriteString("/[^/]+")
+		default:
+			quoted := make([]string, len(segment.alternatives))
+			for i, alternative := range segment.alternatives {
+				quoted[i] = regexp.QuoteMeta(string(alternative))
+			}
+			sb.WriteString("/(" + strings.Join(quoted, "|") + ")")
+		}
+	}
+	sb.WriteString("$")
+
+	return sb.String()
+}
+
+// MatchPathQuery returns a query builder narrowing nodes to those that can match
+// the pattern, using the literal prefix and the depth range of the pattern, and
+// the codes or names the last segment allows.
+// On PostgreSQL and MySQL it is narrowed further with a regular expression.
+// The result may still hold nodes that do not match (MySQL compares without
+// case, other databases have no regular expressions), so MatchPath finishes
+// matching in Go.
+func (tq *TreeQuery) MatchPathQuery(tx *gorm.DB, pattern *PathPattern, tenantID, tenantType string) *gorm.DB {
+	query := tq.scoped(tx, tenantID, tenantType)
+
+	if pattern == nil {
+		query.AddError(ErrInvalidPattern)
+		return query
+	}
+
+	minDepth, maxDepth := pattern.depthRange()
+	if maxDepth == 0 {
+		return query.Where(TreeNode{Path: RootPath})
+	}
+
+	prefix := pattern.literalPrefix()
+	if len(prefix) > 0 {
+		prefixPath := prefix.ToPath()
+		query = query.Where("path = ? OR path LIKE ?", string(prefixPath), prefixPath.GetPathPrefix())
+	}
+
+	switch {
+	case maxDepth < 0 && minDepth == 0:
+		// ** alone matches every node, the root included
+	case maxDepth < 0:
+		query = query.Where("path != ? AND "+depthSQL+" >= ?", string(RootPath), minDepth)
+	default:
+		query = query.Where("path != ? AND "+depthSQL+" BETWEEN ? AND ?", string(RootPath), minDepth, maxDepth)
+	}
+
+	// The last segment matches the node itself
+	if last := pattern.segments[len(pattern.segments)-1]; !last.any && !last.anyDepth {
+		switch {
+		case len(last.names) == 0:
+			query = query.Where("code IN (?)", last.alternatives)
+		case len(last.alternatives) == 0:
+			query = query.Where("name IN (?)", last.names)
+		default:
+			query = query.Where("code IN (?) OR name IN (?)", last.alternatives, last.names)
+		}
+	}
+
+	if expr := pattern.regexp(); expr != "" {
+		switch tx.Dialector.Name() {
+		case "postgres":
+			query = query.Where("path ~ ?", expr)
+		case "mysql":
+			query = query.Where("path REGEXP ?", expr)
+		}
+	}
+
+	return query
+}
+
+// MatchPath retrieves the nodes whose path matches the pattern, ordered by path.
+// See PathPattern for the syntax. Patterns with names in other segments than
+// the last read the names of the candidates' ancestors in a second query.
+func (tq *TreeQuery) MatchPath(pattern string, tenantID, tenantType string) ([]*TreeNode, error) {
+	pp, err := ParsePathPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*TreeNode
+	result := tq.MatchPathQuery(tq.db, pp, tenantID, tenantType).
+		Order("path").
+		Find(&candidates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	var names map[Code]string
+	if usesNames, ancestors := pp.usesNames(); usesNames {
+		if names, err = tq.pathNames(candidates, ancestors, tenantID, tenantType); err != nil {
+			return nil, err
+		}
+	}
+
+	nodes := make([]*TreeNode, 0, len(candidates))
+	for _, node := range candidates {
+		if pp.MatchNames(node.Path, names) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes, nil
+}
+
+// pathNames returns the names of the nodes by code, and with ancestors set the
+// names of all their ancestors
+func (tq *TreeQuery) pathNames(nodes []*TreeNode, ancestors bool, tenantID, tenantType string) (map[Code]string, error) {
+	names := make(map[Code]string)
+	for _, node := range nodes {
+		names[node.Code] = node.Name
+	}
+	if !ancestors {
+		return names, nil
+	}
+
+	var missing []Code
+	for _, node := range nodes {
+		for _, id := range node.Path.GetNodeIDs() {
+			if _, ok := names[id]; !ok {
+				names[id] = ""
+				missing = append(missing, id)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return names, nil
+	}
+
+	var loaded []*TreeNode
+	if err := tq.scoped(tq.db, tenantID, tenantType).
+		Select("code", "name").
+		Where("code IN (?)", missing).
+		Find(&loaded).Error; err != nil {
+		return nil, err
+	}
+	for _, ancestor := range loaded {
+		names[ancestor.Code] = ancestor.Name
+	}
+
+	return names, nil
+}
@@ -0,0 +1,105 @@
+package materialized
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchPath(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", a.Path, "t1", "org")
+	c := mustCreate(t, tq, "c", b.Path, "t1", "org")
+	leaf := mustCreate(t, tq, "leaf-type", c.Path, "t1", "org")
+	shallow := mustCreate(t, tq, "leaf-type", a.Path, "t1", "org")
+	outside := mustCreate(t, tq, "leaf-type", RootPath, "t1", "org")
+	mustCreate(t, tq, "leaf-type", RootPath, "t2", "org")
+
+	tests := []struct {
+		pattern string
+		want    []Code
+	}{
+		{"**/" + string(c.Code), []Code{c.Code}},
+		{string(a.Code) + "/*", []Code{b.Code, shallow.Code}},
+		{string(a.Code) + "/*/*", []Code{c.Code}},
+		{"*/" + string(b.Code) + "|" + string(c.Code), []Code{b.Code}},
+		{string(a.Code) + "/**", []Code{a.Code, b.Code, c.Code, leaf.Code, shallow.Code}},
+
+		// Names
+		{string(a.Code) + "/**/name:leaf-type", []Code{leaf.Code, shallow.Code}},
+		{"name:leaf-type", []Code{outside.Code}},
+		{"**/name:leaf-type", []Code{leaf.Code, shallow.Code, outside.Code}},
+		{"name:a/name:b/**", []Code{b.Code, c.Code, leaf.Code}},
+		{"*/name:b|" + string(shallow.Code), []Code{b.Code, shallow.Code}},
+		{"**/name:c/*", []Code{leaf.Code}},
+		{"**/name:missing", nil},
+
+		// Codes and names are not confused
+		{"**/c", nil},
+		{"name:" + string(a.Code), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			nodes, err := tq.MatchPath(tt.pattern, "t1", "org")
+			if err != nil {
+				t.Fatalf("match: %v", err)
+			}
+			if got := codes(nodes); !sameCodes(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathPatternMatch(t *testing.T) {
+	names := map[Code]string{"A": "root", "B": "team", "C": "leaf"}
+
+	tests := []struct {
+		pattern   string
+		path      Path
+		codes     bool
+		withNames bool
+	}{
+		{"A/*/C", "/A/B/C", true, true},
+		{"A/**/C", "/A/C", true, true},
+		{"**", "/", true, true},
+		{"A/*", "/A/B/C", false, false},
+		{"A/**/name:leaf", "/A/B/C", false, true},
+		{"name:root/name:team", "/A/B", false, true},
+		{"name:team|A/**", "/A/B", true, true},
+		{"name:leaf", "/A/B/C", false, false},
+	}
+	for _, tt := range tests {
+		pp := MustParsePathPattern(tt.pattern)
+		if got := pp.Match(tt.path); got != tt.codes {
+			t.Errorf("%s Match(%s) = %v, want %v", tt.pattern, tt.path, got, tt.codes)
+		}
+		if got := pp.MatchNames(tt.path, names); got != tt.withNames {
+			t.Errorf("%s MatchNames(%s) = %v, want %v", tt.pattern, tt.path, got, tt.withNames)
+		}
+	}
+
+	for _, pattern := range []string{"A//B", "name:", "A|name:", "A*", "A|"} {
+		if _, err := ParsePathPattern(pattern); !errors.Is(err, ErrInvalidPattern) {
+			t.Errorf("ParsePathPattern(%q) = %v, want ErrInvalidPattern", pattern, err)
+		}
+	}
+}
+
+// sameCodes reports whether a and b hold the same codes in any order
+func sameCodes(a, b []Code) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[Code]int, len(a))
+	for _, code := range a {
+		seen[code]++
+	}
+	for _, code := range b {
+		if seen[code] == 0 {
+			return false
+		}
+		seen[code]--
+	}
+	return true
+}
@@ -1,10 +1,14 @@
 package materialized
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
@@ -40,8 +44,47 @@ type TreeNode struct {
 	Path Path   `json:"path,omitempty" gorm:"column:path;index:idx_path"`
 	Name string `json:"name,omitempty" gorm:"column:name"`
 
+	// Position orders a node among its siblings
+	Position int `json:"position,omitempty" gorm:"column:position;default:0"`
+
+	// Version is incremented by every mutation of the node when the table
+	// is configured as Versioned. The column is left out of the schema and
+	// never written by inserts otherwise, see MigrateDefault.
+	Version int64 `json:"version,omitempty" gorm:"column:version;default:0;<-:false;-:migration"`
+
+	// ChildCount and HasChildren are populated by the GetChildrenBy*,
+	// GetNodeWithChildrenBy*, GetLeaves, GetBranches and ExpandTo queries
+	ChildCount  int64 `json:"child_count,omitempty" gorm:"-"`
+	HasChildren bool  `json:"has_children,omitempty" gorm:"-"`
+
+	// HasMoreChildren is set by GetSubtreeNested on nodes at the depth limit
+	// whose children were not loaded
+	HasMoreChildren bool `json:"has_more_children,omitempty" gorm:"-"`
+
+	// Target flags the node ExpandTo expanded to. ChildrenCursor is set by
+	// ExpandTo on nodes whose children were not all loaded; pass it to
+	// GetChildrenByCodePage with the node's code to load the rest.
+	Target         bool   `json:"target,omitempty" gorm:"-"`
+	ChildrenCursor string `json:"children_cursor,omitempty" gorm:"-"`
+
+	// Matched and MatchCount are set by SearchTree: Matched flags a node that
+	// matched the search, MatchCount counts the matches at or below the node
+	Matched    bool  `json:"matched,omitempty" gorm:"-"`
+	MatchCount int64 `json:"match_count,omitempty" gorm:"-"`
+
 	// Owner fields
 	Owner OwnerFields `json:"owner_fields,omitempty" gorm:"embedded"`
+
+	// Metadata holds arbitrary key-value data stored as JSON
+	Metadata Metadata `json:"metadata,omitempty" gorm:"column:metadata"`
+
+	// IdempotencyKey is the key the node was created with, see IdempotencyKey.
+	// Keys are unique per tenant, the index is created by MigrateDefault.
+	IdempotencyKey *string `json:"idempotency_key,omitempty" gorm:"column:idempotency_key;size:255"`
+
+	// IdempotencyHash fingerprints the arguments of the create that used the
+	// idempotency key, so a replay with different arguments is detected
+	IdempotencyHash *string `json:"-" gorm:"column:idempotency_hash;size:64"`
 }
 
 type TenantFields struct {
@@ -60,6 +103,24 @@ type OwnerFields struct {
 type TableConfig struct {
 	// TableName is the name of the table in the database
 	TableName string
+
+	// Versioned makes every mutation increment the version column of the
+	// nodes it changes, enabling the *IfVersion methods. MigrateDefault adds
+	// the column to the tree table only when it is set.
+	Versioned bool
+
+	// LockTableName is the name of the table holding subtree locks.
+	// Subtree locks are disabled when it is empty.
+	LockTableName string
+
+	// OutboxTableName is the name of the table mutations write change events
+	// to, see Relay. The outbox is disabled when it is empty.
+	OutboxTableName string
+
+	// HistoryTableName is the name of the append-only table every mutation
+	// records node history in, e.g. "tree_node_history". History is disabled
+	// when it is empty.
+	HistoryTableName string
 }
 
 // DefaultTableConfig returns the default table configuration
@@ -73,6 +134,21 @@ func DefaultTableConfig() TableConfig {
 type TreeQuery struct {
 	db     *gorm.DB
 	config TableConfig
+
+	// tenantExtractor resolves the tenant for ForContext
+	tenantExtractor TenantExtractor
+
+	// retryPolicy overrides DefaultRetryPolicy for mutations
+	retryPolicy *RetryPolicy
+
+	// lockHolder is the holder whose subtree locks do not block mutations
+	lockHolder string
+
+	// idGenerator overrides DefaultIDGenerator for new nodes
+	idGenerator IDGenerator
+
+	// hooks is shared by all clones of the TreeQuery
+	hooks *Hooks
 }
 
 // NewTreeQuery creates a new TreeQuery instance
@@ -84,16 +160,28 @@ func NewTreeQuery(db *gorm.DB, config TableConfig) (*TreeQuery, error) {
 	return &TreeQuery{
 		db:     db,
 		config: config,
+		hooks:  &Hooks{},
 	}, nil
 }
 
 // tenantScope adds tenant-based security scope to queries
 func (tq *TreeQuery) tenantScope(tenantID, tenantType string) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
-		return db.Where(TenantFields{tenantID, tenantType})
+		// Explicit predicates rather than a struct condition, which would skip
+		// zero values and drop the scope entirely for an empty tenant
+		return db.Where(
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: tenantIDColumn}, Value: tenantID},
+			clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: tenantTypeColumn}, Value: tenantType},
+		)
 	}
 }
 
+// scoped returns a query on the tree table restricted to the given tenant.
+// Every tenant-bound query goes through here so the scope is applied in one place.
+func (tq *TreeQuery) scoped(db *gorm.DB, tenantID, tenantType string) *gorm.DB {
+	return db.Table(tq.config.TableName).Scopes(tq.tenantScope(tenantID, tenantType))
+}
+
 // ownerScope adds owner-based scope to queries
 func (tq *TreeQuery) ownerScope(ownerID, ownerType string) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
@@ -107,8 +195,7 @@ func (tq *TreeQuery) GetNodeByCodeQuery(tx *gorm.DB, code Code, tenantID, tenant
 		return tx
 	}
 
-	return tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tq.db, tenantID, tenantType).
 		Where(TreeNode{Code: code})
 }
 
@@ -127,8 +214,7 @@ func (tq *TreeQuery) GetNodeByCode(code Code, tenantID, tenantType string) (*Tre
 }
 
 func (tq *TreeQuery) GetNodeByIDQuery(tx *gorm.DB, id any, tenantID, tenantType string) *gorm.DB {
-	return tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType))
+	return tq.scoped(tq.db, tenantID, tenantType)
 }
 
 // GetNodeByID retrieves a node by its ID with tenant security
@@ -146,8 +232,7 @@ func (tq *TreeQuery) GetNodeByID(id any, tenantID, tenantType string) (*TreeNode
 }
 
 func (tq *TreeQuery) GetNodeByPathQuery(tx *gorm.DB, path Path, tenantID, tenantType string) *gorm.DB {
-	return tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tq.db, tenantID, tenantType).
 		Where(TreeNode{Path: path})
 }
 
@@ -181,8 +266,7 @@ func (tq *TreeQuery) GetParentByNodeQuery(tx *gorm.DB, node *TreeNode, tenantID,
 		return tx
 	}
 
-	return tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tq.db, tenantID, tenantType).
 		Where(TreeNode{Code: *node.ParentID})
 }
 
@@ -269,22 +353,19 @@ func (tq *TreeQuery) GetChildrenByParentIDQuery(tx *gorm.DB, code *Code, tenantI
 		return tx
 	}
 
-	return tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tx, tenantID, tenantType).
 		Where(TreeNode{ParentID: code})
 }
 
 // GetChildrenByParentID retrieves all direct children of a node
 func (tq *TreeQuery) GetChildrenByParentID(code *Code, tenantID, tenantType string) ([]*TreeNode, error) {
-	var children []*TreeNode
-
-	// Get all nodes where parent_id matches the given node ID
-	result := tq.GetChildrenByParentIDQuery(tq.db, code, tenantID, tenantType).Find(&children)
-	if result.Error != nil {
-		return nil, result.Error
+	// Get all nodes where parent_id matches the given node ID, with their own child counts
+	query := tq.GetChildrenByParentIDQuery(tq.db, code, tenantID, tenantType)
+	if query.Error != nil {
+		return nil, query.Error
 	}
 
-	return children, nil
+	return findWithChildCounts(tq.withChildCounts(query, tenantID, tenantType))
 }
 
 func (tq *TreeQuery) GetChildrenByCodeQuery(tx *gorm.DB, code Code, tenantID, tenantType string) *gorm.DB {
@@ -309,6 +390,36 @@ func (tq *TreeQuery) GetChildrenByCode(code Code, tenantID, tenantType string) (
 	return tq.GetChildrenByParentID(&node.Code, tenantID, tenantType)
 }
 
+// GetChildrenByCodePage retrieves a page of direct children of a node ordered by position.
+// The root's empty code pages the root-level nodes.
+// Pass the NextCursor of the previous page to continue; an empty cursor starts from the beginning.
+func (tq *TreeQuery) GetChildrenByCodePage(
+	code Code,
+	tenantID,
+	tenantType string,
+	limit int,
+	cursor string,
+) (*Page, error) {
+	if code != "" {
+		if err := code.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid code: %w", err)
+		}
+	}
+
+	return tq.find(tq.db, Tenant{tenantID, tenantType},
+		newFindOptions(append(childrenPageOptions(code), Limit(limit), Cursor(cursor))))
+}
+
+// childrenPageOptions returns the filter and order of GetChildrenByCodePage,
+// which determine the shape of its cursors
+func childrenPageOptions(code Code) []FindOption {
+	if code == "" {
+		return []FindOption{AtDepth(1), OrderBy(OrderPosition, false)}
+	}
+
+	return []FindOption{ChildrenOf(code), OrderBy(OrderPosition, false)}
+}
+
 // GetChildrenByPathQuery returns a query builder for retrieving all direct children of a node by its path
 func (tq *TreeQuery) GetChildrenByPathQuery(tx *gorm.DB, parentPath Path, tenantID, tenantType string) *gorm.DB {
 	// First get the node from the path
@@ -335,8 +446,7 @@ func (tq *TreeQuery) GetChildrenByPath(parentPath Path, tenantID, tenantType str
 
 // GetDescendantsQuery returns a query builder for retrieving all descendants of a node
 func (tq *TreeQuery) GetDescendantsQuery(tx *gorm.DB, parentPath Path, tenantID, tenantType string) *gorm.DB {
-	return tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tx, tenantID, tenantType).
 		Where("path LIKE ? AND path != ?", parentPath.GetPathPrefix(), string(parentPath))
 }
 
@@ -354,23 +464,45 @@ func (tq *TreeQuery) GetDescendants(parentPath Path, tenantID, tenantType string
 	return descendants, nil
 }
 
+// GetDescendantsPage retrieves a page of descendants of a node in depth-first order.
+// Pass the NextCursor of the previous page to continue; an empty cursor starts from the beginning.
+func (tq *TreeQuery) GetDescendantsPage(
+	parentPath Path,
+	tenantID,
+	tenantType string,
+	limit int,
+	cursor string,
+) (*Page, error) {
+	return tq.find(tq.db, Tenant{tenantID, tenantType}, newFindOptions([]FindOption{
+		InSubtree(parentPath),
+		OrderBy(OrderPath, false),
+		Limit(limit),
+		Cursor(cursor),
+	}))
+}
+
 // GetAncestorsQuery returns a query builder for retrieving all ancestors of a node
 func (tq *TreeQuery) GetAncestorsQuery(tx *gorm.DB, nodePath Path, tenantID, tenantType string) *gorm.DB {
 	if nodePath.IsRoot() {
 		return tx.Where("1 = 0") // Return empty query for root node
 	}
 
-	ancestorPaths := make([]Path, 0)
-	for i := 1; i <= len(nodePath.GetNodeIDs()); i++ {
+	// Ancestors run from the root path down to the node itself
+	return tq.scoped(tx, tenantID, tenantType).
+		Where("path IN (?)", ancestorPaths(nodePath, 0)).
+		Order("LENGTH(path), path")
+}
+
+// ancestorPaths returns the paths from the ancestor at fromDepth down to the node itself
+func ancestorPaths(nodePath Path, fromDepth int) []Path {
+	paths := make([]Path, 0, nodePath.Depth()+1)
+	for i := fromDepth; i <= nodePath.Depth(); i++ {
 		if ancestorPath, err := nodePath.GetAncestorAtDepth(i); err == nil {
-			ancestorPaths = append(ancestorPaths, ancestorPath)
+			paths = append(paths, ancestorPath)
 		}
 	}
 
-	return tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
-		Where("path IN (?)", ancestorPaths).
-		Order("LENGTH(path), path")
+	return paths
 }
 
 // GetAncestors retrieves all ancestors of a node
@@ -418,6 +550,133 @@ func (tq *TreeQuery) GetAncestorsNested(nodePath Path, tenantID, tenantType stri
 	return root, nil
 }
 
+// GetSubtreeNestedQuery returns a query builder for a node and its descendants
+// up to maxDepth levels below it. A maxDepth of zero or less means no limit.
+// Nodes at the depth limit carry a has_more_children column.
+func (tq *TreeQuery) GetSubtreeNestedQuery(
+	tx *gorm.DB,
+	nodePath Path,
+	tenantID,
+	tenantType string,
+	maxDepth int,
+) *gorm.DB {
+	query := tq.scoped(tx, tenantID, tenantType).
+		Where("path = ? OR path LIKE ?", string(nodePath), nodePath.GetPathPrefix())
+
+	if maxDepth <= 0 {
+		return query
+	}
+
+	cutoff := nodePath.Depth() + maxDepth
+
+	// Correlated check for children below the cutoff, evaluated only on the last loaded level
+	moreChildren := tq.scoped(tx.Session(&gorm.Session{NewDB: true}), tenantID, tenantType).
+		Table(tq.config.TableName + " AS c").
+		Model(&TreeNode{}).
+		Select("1").
+		Where("c.parent_id = " + tq.config.TableName + ".code")
+
+	return query.
+		Select("*, CASE WHEN "+depthSQL+" = ? THEN EXISTS (?) ELSE FALSE END AS has_more_children", cutoff, moreChildren).
+		Where(depthSQL+" <= ?", cutoff)
+}
+
+// GetSubtreeNested retrieves a node with its descendants nested in Children,
+// loaded with a single prefix query and assembled in memory. At RootPath the
+// top-level nodes are nested under the tenant's root node, or under a virtual
+// root without an ID when the tenant has no root row. Siblings are ordered
+// by position, then name. Loading stops maxDepth levels below the node, where
+// HasMoreChildren marks nodes whose children were left out; a maxDepth of zero
+// or less loads the whole subtree.
+func (tq *TreeQuery) GetSubtreeNested(
+	nodePath Path,
+	tenantID,
+	tenantType string,
+	maxDepth int,
+) (*TreeNode, error) {
+	var rows []*struct {
+		TreeNode
+		MoreChildren bool `gorm:"column:has_more_children"`
+	}
+
+	result := tq.GetSubtreeNestedQuery(tq.db, nodePath, tenantID, tenantType, maxDepth).
+		Order("path").
+		Find(&rows)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	nodes := make([]*TreeNode, len(rows))
+	for i, row := range rows {
+		row.TreeNode.HasMoreChildren = row.MoreChildren
+		nodes[i] = &row.TreeNode
+	}
+
+	return nestNodes(nodes, nodePath, nestedSortKeys)
+}
+
+// nestNodes links nodes to their parents by parent code and returns the node at rootPath,
+// with the children of every node ordered by the sort keys.
+// Root-level nodes have no parent code and are attached to the root node. The
+// root path needs no row: without one, a virtual root node is returned.
+func nestNodes(nodes []*TreeNode, rootPath Path, keys []string) (*TreeNode, error) {
+	var top *TreeNode
+	byCode := make(map[Code]*TreeNode, len(nodes))
+	for _, node := range nodes {
+		if node.Path == rootPath {
+			top = node
+		}
+		if node.Code != "" {
+			byCode[node.Code] = node
+		}
+	}
+
+	if top == nil {
+		if !rootPath.IsRoot() {
+			return nil, ErrUnauthorized
+		}
+		top = &TreeNode{Path: RootPath}
+	}
+
+	var root *TreeNode
+	if rootPath.IsRoot() {
+		root = top
+	}
+
+	for _, node := range nodes {
+		if node == top {
+			continue
+		}
+
+		parent := root
+		if node.ParentID != nil {
+			parent = byCode[*node.ParentID]
+		}
+		if parent == nil {
+			continue
+		}
+
+		parent.Children = append(parent.Children, node)
+	}
+
+	sortChildren(top, keys)
+	return top, nil
+}
+
+// nestedSortKeys order the children of nested trees by position, then name
+var nestedSortKeys = []string{"position", "name", "code"}
+
+// sortChildren orders the children of every node by the given sort keys
+func sortChildren(node *TreeNode, keys []string) {
+	sort.SliceStable(node.Children, func(i, j int) bool {
+		return compareSortValues(node.Children[i].sortValues(keys), node.Children[j].sortValues(keys)) < 0
+	})
+
+	for _, child := range node.Children {
+		sortChildren(child, keys)
+	}
+}
+
 // CreateNodeQuery creates a new node query in the tree
 func (tq *TreeQuery) CreateNodeQuery(
 	tx *gorm.DB,
@@ -427,12 +686,20 @@ func (tq *TreeQuery) CreateNodeQuery(
 	tenantType string,
 	ownerID,
 	ownerType string,
+	opts ...CreateOption,
 ) (*TreeNode, *gorm.DB, error) {
 	var parent *TreeNode
 	var parentID *Code // Default to nil for root
 
-	// Generate a unique NodeID
-	newNodeID := NewNodeID()
+	o := newCreateOptions(opts)
+
+	// Use the assigned code or generate a unique NodeID
+	newNodeID := o.code
+	if newNodeID == "" {
+		newNodeID = tq.newID()
+	} else if err := newNodeID.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid code: %w", err)
+	}
 
 	// Create path for new node
 	nodePath, err := parentPath.AppendNode(newNodeID)
@@ -466,6 +733,15 @@ func (tq *TreeQuery) CreateNodeQuery(
 		},
 	}
 
+	if o.idempotencyKey != "" {
+		hash, err := o.fingerprint(name, parentPath, ownerID, ownerType)
+		if err != nil {
+			return nil, nil, err
+		}
+		node.IdempotencyKey = &o.idempotencyKey
+		node.IdempotencyHash = &hash
+	}
+
 	db := tx
 	if db == nil {
 		db = tq.db
@@ -474,7 +750,8 @@ func (tq *TreeQuery) CreateNodeQuery(
 	return node, db.Table(tq.config.TableName), nil
 }
 
-// CreateNode creates a new node in the tree
+// CreateNode creates a new node in the tree.
+// Options can assign the node's code or make the create idempotent.
 func (tq *TreeQuery) CreateNode(
 	name string,
 	parentPath Path,
@@ -482,28 +759,87 @@ func (tq *TreeQuery) CreateNode(
 	tenantType string,
 	ownerID,
 	ownerType string,
+	opts ...CreateOption,
 ) (node *TreeNode, err error) {
-	err = tq.db.Transaction(func(tx *gorm.DB) error {
-		var txErr error
-		node, tx, txErr = tq.CreateNodeQuery(tx, name, parentPath, tenantID, tenantType, ownerID, ownerType)
+	o := newCreateOptions(opts)
+
+	err = tq.transaction(func(tq *TreeQuery) error {
+		// Replays return the node created by the first request
+		if o.idempotencyKey != "" {
+			existing, err := tq.GetNodeByIdempotencyKey(o.idempotencyKey, tenantID, tenantType)
+			if err == nil {
+				if err := o.checkReplay(existing, name, parentPath, ownerID, ownerType); err != nil {
+					return err
+				}
+				node = existing
+				return nil
+			}
+			if !errors.Is(err, ErrUnauthorized) {
+				return err
+			}
+		}
+
+		if err := tq.checkLocks(parentPath, tenantID, tenantType, false); err != nil {
+			return err
+		}
+
+		if o.code != "" {
+			if err := tq.checkCodesAvailable([]Code{o.code}); err != nil {
+				return err
+			}
+		}
+
+		var (
+			tx    *gorm.DB
+			txErr error
+		)
+		node, tx, txErr = tq.CreateNodeQuery(tq.db, name, parentPath, tenantID, tenantType, ownerID, ownerType, opts...)
 		if txErr != nil {
 			return txErr
 		}
 
+		event := &CreateEvent{Tenant: Tenant{tenantID, tenantType}, Node: node}
+		if err := runHooks(tq.db, tq.hooks.registered().beforeCreate, event); err != nil {
+			return err
+		}
+
 		if err := tx.Create(node).Error; err != nil {
 			return err
 		}
 
-		return nil
+		if err := tq.writeHistory(historyEntry(HistoryCreated, tenantID, tenantType, nil, node)); err != nil {
+			return err
+		}
+
+		if err := tq.writeOutbox(nodeEvent(EventNodeCreated, node)); err != nil {
+			return err
+		}
+
+		return runHooks(tq.db, tq.hooks.registered().afterCreate, event)
 	})
 
 	if err != nil {
+		// A concurrent replay may have won the race for the idempotency key
+		if o.idempotencyKey != "" {
+			if existing, lookupErr := tq.GetNodeByIdempotencyKey(o.idempotencyKey, tenantID, tenantType); lookupErr == nil {
+				if err := o.checkReplay(existing, name, parentPath, ownerID, ownerType); err != nil {
+					return nil, err
+				}
+				return existing, nil
+			}
+		}
 		return nil, err
 	}
 
 	return node, nil
 }
 
+// touch sets updated_at in the column updates of a mutation, which GORM
+// leaves alone for updates without a model
+func touch(updates map[string]interface{}) {
+	updates["updated_at"] = time.Now()
+}
+
 // UpdateNodeQuery prepares the query for updating a node
 func (tq *TreeQuery) UpdateNodeQuery(
 	tx *gorm.DB,
@@ -513,11 +849,15 @@ func (tq *TreeQuery) UpdateNodeQuery(
 	updates map[string]interface{},
 ) (*gorm.DB, error) {
 	// First check if node exists and belongs to tenant
-	_, err := tq.GetNodeByCode(code, tenantID, tenantType)
+	node, err := tq.GetNodeByCode(code, tenantID, tenantType)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := tq.checkLocks(node.Path, tenantID, tenantType, false); err != nil {
+		return nil, err
+	}
+
 	// Remove protected fields from updates
 	delete(updates, "id")
 	delete(updates, "created_at")
@@ -528,6 +868,10 @@ func (tq *TreeQuery) UpdateNodeQuery(
 	delete(updates, "path")
 	delete(updates, "tenant_id")
 	delete(updates, "tenant_type")
+	delete(updates, "version")
+
+	touch(updates)
+	tq.bumpVersion(updates)
 
 	db := tx
 	if db == nil {
@@ -535,8 +879,7 @@ func (tq *TreeQuery) UpdateNodeQuery(
 	}
 
 	// Prepare update query
-	query := db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	query := tq.scoped(db, tenantID, tenantType).
 		Where(TreeNode{Code: code})
 
 	return query, nil
@@ -549,88 +892,246 @@ func (tq *TreeQuery) UpdateNode(
 	tenantType string,
 	updates map[string]interface{},
 ) error {
-	query, err := tq.UpdateNodeQuery(tq.db, code, tenantID, tenantType, updates)
-	if err != nil {
+	return tq.transaction(func(tq *TreeQuery) error {
+		before, err := tq.beforeUpdate(code, tenantID, tenantType)
+		if err != nil {
+			return err
+		}
+
+		query, err := tq.UpdateNodeQuery(tq.db, code, tenantID, tenantType, updates)
+		if err != nil {
+			return err
+		}
+
+		if err := query.Updates(updates).Error; err != nil {
+			return err
+		}
+
+		return tq.afterUpdate(code, tenantID, tenantType, before, nil, updates)
+	})
+}
+
+// beforeUpdate reads the node with the given code before an update when its
+// previous state is recorded in the history
+func (tq *TreeQuery) beforeUpdate(code Code, tenantID, tenantType string) (*TreeNode, error) {
+	if !tq.historyEnabled() {
+		return nil, nil
+	}
+
+	return tq.GetNodeByCode(code, tenantID, tenantType)
+}
+
+// afterUpdate records the update in the history and the outbox and runs the
+// after-update hooks for the node with the given code, reading it unless the
+// updated node is supplied
+func (tq *TreeQuery) afterUpdate(
+	code Code,
+	tenantID,
+	tenantType string,
+	before,
+	node *TreeNode,
+	updates map[string]interface{},
+) error {
+	if !tq.hooks.hasUpdate() && tq.config.OutboxTableName == "" && !tq.historyEnabled() {
+		return nil
+	}
+
+	if node == nil {
+		var err error
+		if node, err = tq.GetNodeByCode(code, tenantID, tenantType); err != nil {
+			return err
+		}
+	}
+
+	if err := tq.writeHistory(historyEntry(HistoryUpdated, tenantID, tenantType, before, node)); err != nil {
+		return err
+	}
+
+	if err := tq.writeOutbox(nodeEvent(EventNodeUpdated, node)); err != nil {
 		return err
 	}
 
-	result := query.Updates(updates)
-	return result.Error
+	return runHooks(tq.db, tq.hooks.registered().afterUpdate, &UpdateEvent{
+		Tenant:  Tenant{tenantID, tenantType},
+		Node:    node,
+		Updates: updates,
+	})
 }
 
-// MoveNode moves a node and all its descendants to a new parent
+// MoveNode moves a node and all its descendants to a new parent.
+// The node and the new parent are read and locked inside the transaction, so
+// concurrent moves cannot create a cycle or rewrite paths from stale state.
+// Serialization failures and deadlocks are retried, see WithRetryPolicy.
 func (tq *TreeQuery) MoveNode(
 	nodePath Path,
 	newParentPath Path,
 	tenantID,
 	tenantType string,
 ) error {
-	// Start a transaction
-	tx := tq.db.Begin()
-	if tx.Error != nil {
-		return tx.Error
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+	return tq.transaction(func(tq *TreeQuery) error {
+		return tq.moveNode(nodePath, newParentPath, tenantID, tenantType, nil)
+	})
+}
+
+// moveNode moves a node within the current transaction. With an expected
+// version it fails with ErrConflict when the node has a different version.
+func (tq *TreeQuery) moveNode(
+	nodePath Path,
+	newParentPath Path,
+	tenantID,
+	tenantType string,
+	expectedVersion *int64,
+) error {
+	if nodePath == newParentPath || nodePath.Contains(newParentPath) {
+		return errors.New("cannot move a node to its own descendant")
+	}
+
+	// Lock the node and the new parent in path order so concurrent moves
+	// acquire their locks in the same order
+	lockPaths := []Path{nodePath}
+	if !newParentPath.IsRoot() {
+		lockPaths = append(lockPaths, newParentPath)
+	}
+
+	var locked []*TreeNode
+	if err := forUpdate(tq.scoped(tq.db, tenantID, tenantType)).
+		Where("path IN (?)", lockPaths).
+		Order("path").
+		Find(&locked).Error; err != nil {
+		return err
+	}
+
+	var node, newParent *TreeNode
+	for _, n := range locked {
+		switch n.Path {
+		case nodePath:
+			node = n
+		case newParentPath:
+			newParent = n
 		}
-	}()
+	}
 
 	// Get the node to move
-	node, err := tq.GetNodeByPath(nodePath, tenantID, tenantType)
-	if err != nil {
-		tx.Rollback()
+	if node == nil {
+		return ErrUnauthorized
+	}
+	if expectedVersion != nil && node.Version != *expectedVersion {
+		return ErrConflict
+	}
+
+	// Moving out of a locked subtree or into one are both blocked
+	if err := tq.checkLocks(nodePath, tenantID, tenantType, true); err != nil {
+		return err
+	}
+	if err := tq.checkLocks(newParentPath, tenantID, tenantType, false); err != nil {
 		return err
 	}
 
 	// Get new parent ID
 	var newParentID *Code // Default to nil for root
 	if !newParentPath.IsRoot() {
-		newParent, err := tq.GetNodeByPath(newParentPath, tenantID, tenantType)
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("new parent node not found: %w", err)
-		}
-		newParentID = newParent.ParentID
-
-		// Check that new parent is not a descendant of the node being moved
-		if nodePath.Contains(newParentPath) {
-			tx.Rollback()
-			return errors.New("cannot move a node to its own descendant")
+		if newParent == nil {
+			return fmt.Errorf("new parent node not found: %w", ErrUnauthorized)
 		}
+		newParentID = &newParent.Code
 	}
 
 	// Create new path for the node
 	newPath, err := newParentPath.AppendNode(node.Code)
 	if err != nil {
-		tx.Rollback()
 		return err
 	}
 
+	var subtree []*TreeNode
+	if tq.hooks.hasMove() || tq.historyEnabled() {
+		if subtree, err = tq.subtreeNodes(nodePath, tenantID, tenantType); err != nil {
+			return err
+		}
+	}
+
+	var event *MoveEvent
+	if tq.hooks.hasMove() {
+		event = &MoveEvent{
+			Tenant:      Tenant{tenantID, tenantType},
+			Code:        node.Code,
+			OldParentID: node.ParentID,
+			NewParentID: newParentID,
+			Moved:       movedPaths(subtree, nodePath, newPath),
+		}
+		if err := runHooks(tq.db, tq.hooks.registered().beforeMove, event); err != nil {
+			return err
+		}
+	}
+
+	// Update the moved node's parent_id first, guarded by the expected version
+	// where the row could not be locked
+	query := tq.scoped(tq.db, tenantID, tenantType).
+		Where(TreeNode{Code: node.Code})
+	if expectedVersion != nil {
+		query = query.Where("version = ?", *expectedVersion)
+	}
+
+	result := query.Update("parent_id", newParentID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if expectedVersion != nil && result.RowsAffected == 0 {
+		return ErrConflict
+	}
+
 	// Update the node and all its descendants in a single query
-	if err := tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	updates := map[string]interface{}{
+		"path": gorm.Expr("CONCAT(?, SUBSTRING(path, ?))",
+			string(newPath),
+			len(string(nodePath))+1,
+		),
+	}
+	touch(updates)
+	tq.bumpVersion(updates)
+
+	if err := tq.scoped(tq.db, tenantID, tenantType).
 		Where("path = ? OR path LIKE ?", string(nodePath), nodePath.GetPathPrefix()).
-		Updates(map[string]interface{}{
-			"path": gorm.Expr("CONCAT(?, SUBSTRING(path, ?))",
-				string(newPath),
-				len(string(nodePath))+1,
-			),
-		}).Error; err != nil {
-		tx.Rollback()
+		Updates(updates).Error; err != nil {
 		return err
 	}
 
-	// Update the moved node's parent_id separately
-	if err := tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
-		Where(TreeNode{Code: node.Code}).
-		Updates(&TreeNode{ParentID: newParentID}).Error; err != nil {
-		tx.Rollback()
+	if err := tq.moveLocks(nodePath, newPath, tenantID, tenantType); err != nil {
 		return err
 	}
 
-	return tx.Commit().Error
+	if tq.historyEnabled() {
+		entries := make([]*NodeHistory, 0, len(subtree))
+		for _, before := range subtree {
+			after := *before
+			after.Path = newPath + before.Path[len(nodePath):]
+			if before.Code == node.Code {
+				after.ParentID = newParentID
+			}
+			entries = append(entries, historyEntry(HistoryMoved, tenantID, tenantType, before, &after))
+		}
+		if err := tq.writeHistory(entries...); err != nil {
+			return err
+		}
+	}
+
+	if err := tq.writeOutbox(&OutboxEvent{
+		Type:        EventSubtreeMoved,
+		TenantID:    tenantID,
+		TenantType:  tenantType,
+		Code:        node.Code,
+		ParentID:    newParentID,
+		Path:        newPath,
+		OldParentID: node.ParentID,
+		OldPath:     nodePath,
+	}); err != nil {
+		return err
+	}
+
+	if event == nil {
+		return nil
+	}
+
+	return runHooks(tq.db, tq.hooks.registered().afterMove, event)
 }
 
 // DeleteNode deletes a node and optionally its descendants
@@ -640,41 +1141,44 @@ func (tq *TreeQuery) DeleteNode(
 	tenantType string,
 	deleteDescendants bool,
 ) error {
-	// Start a transaction
-	tx := tq.db.Begin()
-	if tx.Error != nil {
-		return tx.Error
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
+	return tq.transaction(func(tq *TreeQuery) error {
+		return tq.deleteNode(nodePath, tenantID, tenantType, deleteDescendants)
+	})
+}
+
+func (tq *TreeQuery) deleteNode(
+	nodePath Path,
+	tenantID,
+	tenantType string,
+	deleteDescendants bool,
+) error {
+	// Verify node exists and belongs to tenant, locking it against concurrent moves
+	var node TreeNode
+	if err := forUpdate(tq.GetNodeByPathQuery(tq.db, nodePath, tenantID, tenantType)).
+		First(&node).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUnauthorized
 		}
-	}()
+		return err
+	}
 
-	// Verify node exists and belongs to tenant
-	_, err := tq.GetNodeByPath(nodePath, tenantID, tenantType)
-	if err != nil {
-		tx.Rollback()
+	if err := tq.checkLocks(nodePath, tenantID, tenantType, true); err != nil {
 		return err
 	}
 
 	// Check if node has descendants without loading them all into memory
 	var count int64
-	if err := tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	if err := tq.scoped(tq.db, tenantID, tenantType).
 		Where("path LIKE ? AND path != ?", nodePath.GetPathPrefix(), string(nodePath)).
 		Count(&count).Error; err != nil {
-		tx.Rollback()
 		return err
 	}
 
 	// Delete the node and its descendants if requested
-	query := tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType))
+	query := tq.scoped(tq.db, tenantID, tenantType)
 
 	if !deleteDescendants {
 		if count > 0 {
-			tx.Rollback()
 			return errors.New("cannot delete node with descendants, set deleteDescendants to true")
 		}
 
@@ -683,38 +1187,82 @@ func (tq *TreeQuery) DeleteNode(
 		query = query.Where("path = ? OR path LIKE ?", string(nodePath), nodePath.GetPathPrefix())
 	}
 
+	var deleted []*TreeNode
+	if tq.hooks.hasDelete() || tq.historyEnabled() {
+		if err := query.Session(&gorm.Session{}).Order("path").Find(&deleted).Error; err != nil {
+			return err
+		}
+	}
+
+	var event *DeleteEvent
+	if tq.hooks.hasDelete() {
+		event = &DeleteEvent{Tenant: Tenant{tenantID, tenantType}, Node: &node, Deleted: deleted}
+		if err := runHooks(tq.db, tq.hooks.registered().beforeDelete, event); err != nil {
+			return err
+		}
+	}
+
 	if err := query.Delete(&TreeNode{}).Error; err != nil {
-		tx.Rollback()
 		return err
 	}
 
-	return tx.Commit().Error
+	entries := make([]*NodeHistory, 0, len(deleted))
+	for _, before := range deleted {
+		entries = append(entries, historyEntry(HistoryDeleted, tenantID, tenantType, before, nil))
+	}
+	if err := tq.writeHistory(entries...); err != nil {
+		return err
+	}
+
+	eventType := EventNodeDeleted
+	if count > 0 {
+		eventType = EventSubtreeDeleted
+	}
+	if err := tq.writeOutbox(&OutboxEvent{
+		Type:        eventType,
+		TenantID:    tenantID,
+		TenantType:  tenantType,
+		Code:        node.Code,
+		OldParentID: node.ParentID,
+		OldPath:     node.Path,
+	}); err != nil {
+		return err
+	}
+
+	if event == nil {
+		return nil
+	}
+
+	return runHooks(tq.db, tq.hooks.registered().afterDelete, event)
 }
 
-// SearchNodes searches for nodes by name or metadata with tenant security
+// SearchNodes searches for nodes by name or metadata with tenant security.
+// Names containing query match by default; options such as MatchBy, IgnoreCase,
+// InSubtree, DepthBetween, OwnedBy, CreatedBetween or MetadataEquals refine the
+// search. Exact matches rank first, then prefix matches, then the rest, and
+// shallower nodes come before deeper ones.
 func (tq *TreeQuery) SearchNodes(
 	query string,
 	tenantID,
 	tenantType string,
 	limit int,
 	offset int,
+	opts ...FindOption,
 ) ([]*TreeNode, int64, error) {
 	var nodes []*TreeNode
 	var count int64
 
-	// Count total matches
-	countQuery := tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
-		Where("name LIKE ?", "%"+query+"%")
+	tenant := Tenant{tenantID, tenantType}
+	o := newFindOptions(append([]FindOption{NameMatches(query)}, opts...))
 
-	if err := countQuery.Count(&count).Error; err != nil {
+	// Count total matches
+	if err := tq.findQuery(tq.db, tenant, o).Count(&count).Error; err != nil {
 		return nil, 0, err
 	}
 
 	// Get paginated results
-	result := tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
-		Where("name LIKE ?", "%"+query+"%").
+	result := tq.findQuery(tq.db, tenant, o).
+		Order(o.rankOrder()).
 		Limit(limit).
 		Offset(offset).
 		Find(&nodes)
@@ -726,6 +1274,24 @@ func (tq *TreeQuery) SearchNodes(
 	return nodes, count, nil
 }
 
+// SearchNodesPage searches for nodes by name, returning a page in creation order.
+// Unlike SearchNodes it pages with a cursor instead of an offset, so inserts
+// between requests neither skip nor repeat rows.
+func (tq *TreeQuery) SearchNodesPage(
+	query string,
+	tenantID,
+	tenantType string,
+	limit int,
+	cursor string,
+) (*Page, error) {
+	return tq.find(tq.db, Tenant{tenantID, tenantType}, newFindOptions([]FindOption{
+		NameMatches(query),
+		OrderBy(OrderCode, false),
+		Limit(limit),
+		Cursor(cursor),
+	}))
+}
+
 // GetNodesByOwnerQuery returns a query builder for nodes associated with a specific owner
 func (tq *TreeQuery) GetNodesByOwnerQuery(
 	ownerID,
@@ -733,8 +1299,7 @@ func (tq *TreeQuery) GetNodesByOwnerQuery(
 	tenantID,
 	tenantType string,
 ) *gorm.DB {
-	return tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tq.db, tenantID, tenantType).
 		Scopes(tq.ownerScope(ownerID, ownerType))
 }
 
@@ -770,6 +1335,23 @@ func (tq *TreeQuery) GetNodesByOwner(
 	return nodes, count, nil
 }
 
+// GetNodesByOwnerPage retrieves a page of nodes associated with a specific owner in creation order
+func (tq *TreeQuery) GetNodesByOwnerPage(
+	ownerID,
+	ownerType,
+	tenantID,
+	tenantType string,
+	limit int,
+	cursor string,
+) (*Page, error) {
+	return tq.find(tq.db, Tenant{tenantID, tenantType}, newFindOptions([]FindOption{
+		OwnedBy(OwnerFields{ownerID, ownerType}),
+		OrderBy(OrderCode, false),
+		Limit(limit),
+		Cursor(cursor),
+	}))
+}
+
 // GetNodesByDepthQuery returns a query builder for nodes at a specific depth in the tree
 func (tq *TreeQuery) GetNodesByDepthQuery(
 	tx *gorm.DB,
@@ -783,8 +1365,7 @@ func (tq *TreeQuery) GetNodesByDepthQuery(
 	}
 
 	// For other depths, we need to count path separators
-	return tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tx, tenantID, tenantType).
 		Where("(LENGTH(path) - LENGTH(REPLACE(path, ?, ''))) / ? = ?", PathSeparator, len(PathSeparator), depth)
 }
 
@@ -822,17 +1403,16 @@ func (tq *TreeQuery) GetRootNodeQuery(
 	tenantID,
 	tenantType string,
 ) *gorm.DB {
-	return tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	return tq.scoped(tx, tenantID, tenantType).
 		Where(TreeNode{Path: RootPath})
 }
 
-// GetRootNode retrieves the root node for a tenant
+// GetRootNode retrieves the root node for a tenant, creating it on first access.
+// Creating it writes a NodeCreated event to the outbox but runs no create hooks.
 func (tq *TreeQuery) GetRootNode(tenantID, tenantType string) (*TreeNode, error) {
 	var rootNode TreeNode
 
-	result := tq.db.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	result := tq.scoped(tq.db, tenantID, tenantType).
 		Where(TreeNode{Path: RootPath}).
 		First(&rootNode)
 
@@ -845,7 +1425,13 @@ func (tq *TreeQuery) GetRootNode(tenantID, tenantType string) (*TreeNode, error)
 				Tenant: TenantFields{tenantID, tenantType},
 			}
 
-			if err := tq.db.Table(tq.config.TableName).Create(&rootNode).Error; err != nil {
+			if err := tq.transaction(func(tq *TreeQuery) error {
+				if err := tq.db.Table(tq.config.TableName).Create(&rootNode).Error; err != nil {
+					return err
+				}
+
+				return tq.writeOutbox(nodeEvent(EventNodeCreated, &rootNode))
+			}); err != nil {
 				return nil, err
 			}
 
@@ -857,7 +1443,8 @@ func (tq *TreeQuery) GetRootNode(tenantID, tenantType string) (*TreeNode, error)
 	return &rootNode, nil
 }
 
-// BatchCreateNodes creates multiple nodes in a single transaction
+// BatchCreateNodes creates multiple nodes in a single transaction.
+// Use ImportNodes to supply the codes of the new nodes.
 func (tq *TreeQuery) BatchCreateNodes(
 	nodes []struct {
 		Name       string
@@ -868,111 +1455,76 @@ func (tq *TreeQuery) BatchCreateNodes(
 	tenantID,
 	tenantType string,
 ) ([]*TreeNode, error) {
-	tx := tq.db.Begin()
-	if tx.Error != nil {
-		return nil, tx.Error
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
-
-	createdNodes := make([]*TreeNode, 0, len(nodes))
-	batchNodes := make([]*TreeNode, 0, len(nodes))
-
-	// Create a map to store parent paths and their IDs
-	parentPathMap := make(map[Path]*Code)
-	uniqueParentPaths := make([]Path, 0)
-
-	// Collect unique parent paths
-	for _, nodeInfo := range nodes {
-		if !nodeInfo.ParentPath.IsRoot() {
-			parentPathStr := nodeInfo.ParentPath
-			if _, exists := parentPathMap[parentPathStr]; !exists {
-				uniqueParentPaths = append(uniqueParentPaths, nodeInfo.ParentPath)
-			}
+	batch := make([]BatchNode, len(nodes))
+	for i, nodeInfo := range nodes {
+		batch[i] = BatchNode{
+			Name:       nodeInfo.Name,
+			ParentPath: nodeInfo.ParentPath,
+			OwnerID:    nodeInfo.OwnerID,
+			OwnerType:  nodeInfo.OwnerType,
 		}
 	}
 
-	// Fetch all parent nodes in a single query
-	if len(uniqueParentPaths) > 0 {
-		var parentNodes []*TreeNode
-		result := tx.Table(tq.config.TableName).
-			Scopes(tq.tenantScope(tenantID, tenantType)).
-			Where("path IN (?)", uniqueParentPaths).
-			Find(&parentNodes)
-
-		if result.Error != nil {
-			tx.Rollback()
-			return nil, result.Error
-		}
+	return tq.ImportNodes(batch, tenantID, tenantType)
+}
 
-		// Build parent path to ID map
-		for _, parent := range parentNodes {
-			parentPathMap[parent.Path] = &parent.Code
-		}
+// MigrateDefault creates the database schema for the tree table
+func (tq *TreeQuery) MigrateDefault() error {
+	if err := CrossTenant(tq.db).AutoMigrate(&TreeNode{}); err != nil {
+		return err
 	}
 
-	// Create nodes using the parent path map
-	for _, nodeInfo := range nodes {
-		var parentID *Code
-		if !nodeInfo.ParentPath.IsRoot() {
-			var exists bool
-			parentID, exists = parentPathMap[nodeInfo.ParentPath]
-			if !exists {
-				tx.Rollback()
-				return nil, fmt.Errorf("parent node not found for path %s", nodeInfo.ParentPath)
-			}
-		}
+	if err := tq.migrateIdempotencyIndex(); err != nil {
+		return err
+	}
 
-		newNodeID := NewNodeID()
-		nodePath, err := nodeInfo.ParentPath.AppendNode(newNodeID)
-		if err != nil {
-			tx.Rollback()
-			return nil, err
+	if tq.config.Versioned {
+		if err := tq.MigrateVersion(); err != nil {
+			return err
 		}
+	}
 
-		node := &TreeNode{
-			Code:     newNodeID,
-			Path:     nodePath,
-			Name:     nodeInfo.Name,
-			ParentID: parentID,
-			Tenant:   TenantFields{tenantID, tenantType},
-			Owner:    OwnerFields{nodeInfo.OwnerID, nodeInfo.OwnerType},
+	if tq.config.LockTableName != "" {
+		if err := tq.MigrateLocks(); err != nil {
+			return err
 		}
-
-		batchNodes = append(batchNodes, node)
 	}
 
-	if err := tx.Table(tq.config.TableName).CreateInBatches(batchNodes, 100).Error; err != nil {
-		tx.Rollback()
-		return nil, err
+	if tq.config.OutboxTableName != "" {
+		if err := tq.MigrateOutbox(); err != nil {
+			return err
+		}
 	}
 
-	if err := tx.Commit().Error; err != nil {
-		return nil, err
+	if tq.config.HistoryTableName != "" {
+		return tq.MigrateHistory()
 	}
 
-	createdNodes = append(createdNodes, batchNodes...)
-	return createdNodes, nil
-}
-
-// MigrateDefault creates the database schema for the tree table
-func (tq *TreeQuery) MigrateDefault() error {
-	return tq.db.AutoMigrate(&TreeNode{})
+	return nil
 }
 
 func (tq *TreeQuery) Migrate(m any) error {
-	return tq.db.AutoMigrate(m)
+	return CrossTenant(tq.db).AutoMigrate(m)
 }
 
 // WithTransaction allows executing operations within an existing transaction
 func (tq *TreeQuery) WithTransaction(tx *gorm.DB) *TreeQuery {
-	return &TreeQuery{
-		db:     tx,
-		config: tq.config,
-	}
+	return tq.clone(tx)
+}
+
+// WithContext returns a TreeQuery whose queries run with the given context.
+// The context reaches every statement issued by the returned instance, including
+// the nested lookups performed by MoveNode, DeleteNode and the *Query builders,
+// so cancellation and deadlines are honoured throughout.
+func (tq *TreeQuery) WithContext(ctx context.Context) *TreeQuery {
+	return tq.clone(tq.db.WithContext(ctx))
+}
+
+// clone returns a copy of the TreeQuery bound to db
+func (tq *TreeQuery) clone(db *gorm.DB) *TreeQuery {
+	c := *tq
+	c.db = db
+	return &c
 }
 
 // GetNodeWithChildrenByPathQuery returns a query builder for retrieving a node with its direct children by path
@@ -984,8 +1536,12 @@ func (tq *TreeQuery) GetNodeWithChildrenByPathQuery(
 	limit,
 	offset int,
 ) (*gorm.DB, *TreeNode, int64, error) {
+	var code Code
 	node, err := tq.GetNodeByPath(path, tenantID, tenantType)
-	tx, count, err := tq.loadNodeChildrenQuery(tx, tenantID, tenantType, node.Code, limit, offset, err)
+	if node != nil {
+		code = node.Code
+	}
+	tx, count, err := tq.loadNodeChildrenQuery(tx, tenantID, tenantType, code, limit, offset, err)
 	if err != nil {
 		return tx, nil, 0, err
 	}
@@ -1008,6 +1564,9 @@ func (tq *TreeQuery) GetNodeWithChildrenByPath(
 		return nil, 0, err
 	}
 
+	node.ChildCount = count
+	node.HasChildren = count > 0
+
 	return node, count, nil
 }
 
@@ -1044,6 +1603,9 @@ func (tq *TreeQuery) GetNodeWithChildrenByCode(
 		return nil, 0, err
 	}
 
+	node.ChildCount = count
+	node.HasChildren = count > 0
+
 	return node, count, nil
 }
 
@@ -1065,8 +1627,7 @@ func (tq *TreeQuery) loadNodeChildrenQuery(
 		return nil, 0, loadErr
 	}
 
-	query := tx.Table(tq.config.TableName).
-		Scopes(tq.tenantScope(tenantID, tenantType)).
+	query := tq.scoped(tx, tenantID, tenantType).
 		Where(TreeNode{ParentID: &parentCode})
 
 	var count int64
@@ -1086,8 +1647,8 @@ func (tq *TreeQuery) setNodeChildren(
 		return err
 	}
 
-	var children []*TreeNode
-	if err := query.Find(&children).Error; err != nil {
+	children, err := findWithChildCounts(tq.withChildCounts(query, node.Tenant.ID, node.Tenant.Type))
+	if err != nil {
 		return err
 	}
 
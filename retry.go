@@ -0,0 +1,147 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RetryPolicy controls how mutations are retried after serialization failures
+// and deadlocks
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a transaction is run, 1 disables retries
+	MaxAttempts int
+
+	// BaseDelay is the backoff before the first retry, doubled for every further one
+	BaseDelay time.Duration
+
+	// MaxDelay caps the backoff
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy returns the retry policy used unless WithRetryPolicy is called
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   10 * time.Millisecond,
+		MaxDelay:    500 * time.Millisecond,
+	}
+}
+
+// WithRetryPolicy returns a TreeQuery retrying mutations with the given policy
+func (tq *TreeQuery) WithRetryPolicy(policy RetryPolicy) *TreeQuery {
+	c := tq.clone(tq.db)
+	c.retryPolicy = &policy
+	return c
+}
+
+// backoff returns a random delay before the given retry, growing exponentially
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay << retry
+	if delay <= 0 || delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// IsRetryable reports whether err is a serialization failure, a deadlock or a
+// lock timeout after which the whole transaction can be run again
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// PostgreSQL drivers expose the SQLSTATE of the error
+	var state interface{ SQLState() string }
+	if errors.As(err, &state) {
+		switch state.SQLState() {
+		case "40001", "40P01":
+			return true
+		}
+	}
+
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{
+		"deadlock",
+		"could not serialize",
+		"serialization failure",
+		"lock wait timeout",
+		"database is locked",
+		"database table is locked",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inTransaction reports whether the TreeQuery is bound to an open transaction
+func (tq *TreeQuery) inTransaction() bool {
+	committer, ok := tq.db.Statement.ConnPool.(gorm.TxCommitter)
+	return ok && committer != nil
+}
+
+// transaction runs fn in a transaction with a TreeQuery bound to it, so every
+// read and write of fn sees the same state. Serialization failures and deadlocks
+// rerun the whole transaction with backoff. Inside an outer transaction fn runs
+// in a savepoint and is not retried, as only the outer transaction can be.
+func (tq *TreeQuery) transaction(fn func(tq *TreeQuery) error) error {
+	run := func() error {
+		return tq.db.Transaction(func(tx *gorm.DB) error {
+			return fn(tq.clone(tx))
+		})
+	}
+
+	if tq.inTransaction() {
+		return run()
+	}
+
+	policy := DefaultRetryPolicy()
+	if tq.retryPolicy != nil {
+		policy = *tq.retryPolicy
+	}
+
+	ctx := tq.db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = run()
+		if !IsRetryable(err) || attempt+1 >= policy.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(policy.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// forUpdate locks the rows read by query until the end of the transaction on
+// databases supporting SELECT ... FOR UPDATE. SQLite locks the whole database
+// for writing instead.
+func forUpdate(query *gorm.DB) *gorm.DB {
+	switch query.Dialector.Name() {
+	case "postgres", "mysql":
+		return query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	return query
+}
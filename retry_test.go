@@ -0,0 +1,159 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestMoveNodeRetriesRetryableErrors(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig()).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+
+	var attempts int32
+	tq.Hooks().BeforeMove(func(tx *gorm.DB, event *MoveEvent) error {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return errors.New("Error 1213: Deadlock found when trying to get lock")
+		}
+		return nil
+	})
+
+	if err := tq.MoveNode(b.Path, a.Path, "t1", "org"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("got %d attempts, want 2", attempts)
+	}
+
+	moved, err := tq.GetNodeByCode(b.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := a.Path.AppendNode(b.Code); moved.Path != want {
+		t.Fatalf("got path %s, want %s", moved.Path, want)
+	}
+}
+
+func TestMoveNodeStopsAfterMaxAttempts(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig()).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond})
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+
+	var attempts int32
+	hookErr := errors.New("database is locked")
+	tq.Hooks().BeforeMove(func(tx *gorm.DB, event *MoveEvent) error {
+		atomic.AddInt32(&attempts, 1)
+		return hookErr
+	})
+
+	if err := tq.MoveNode(b.Path, a.Path, "t1", "org"); !IsRetryable(err) {
+		t.Fatalf("got %v, want the retryable error", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("got %d attempts, want 3", attempts)
+	}
+
+	// Non-retryable errors are returned at once
+	attempts = 0
+	hookErr = errors.New("vetoed")
+	if err := tq.MoveNode(a.Path, b.Path, "t1", "org"); err == nil {
+		t.Fatal("move succeeded, want the veto")
+	}
+	if attempts != 1 {
+		t.Fatalf("got %d attempts, want 1", attempts)
+	}
+}
+
+func TestConcurrentMoveNodeKeepsTreeConsistent(t *testing.T) {
+	const (
+		nodes      = 30
+		workers    = 8
+		movesEach  = 25
+		tenantID   = "t1"
+		tenantType = "org"
+	)
+
+	tq := newTestTree(t, DefaultTableConfig()).
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 50, BaseDelay: time.Millisecond, MaxDelay: 20 * time.Millisecond})
+
+	codes := make([]Code, 0, nodes)
+	parents := []Path{RootPath}
+	for i := 0; i < nodes; i++ {
+		node := mustCreate(t, tq, fmt.Sprintf("n%d", i), parents[rand.Intn(len(parents))], tenantID, tenantType)
+		codes = append(codes, node.Code)
+		parents = append(parents, node.Path)
+	}
+
+	var moved int32
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+
+			for i := 0; i < movesEach; i++ {
+				node, err := tq.GetNodeByCode(codes[rng.Intn(len(codes))], tenantID, tenantType)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				newParentPath := RootPath
+				if n := rng.Intn(len(codes) + 1); n < len(codes) {
+					parent, err := tq.GetNodeByCode(codes[n], tenantID, tenantType)
+					if err != nil {
+						errs <- err
+						return
+					}
+					newParentPath = parent.Path
+				}
+
+				// Paths read before the move may be stale by the time it runs
+				err = tq.MoveNode(node.Path, newParentPath, tenantID, tenantType)
+				switch {
+				case err == nil:
+					atomic.AddInt32(&moved, 1)
+				case errors.Is(err, ErrUnauthorized),
+					strings.Contains(err.Error(), "own descendant"):
+				default:
+					errs <- fmt.Errorf("move %s to %s: %w", node.Path, newParentPath, err)
+					return
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if moved == 0 {
+		t.Fatal("no move succeeded")
+	}
+
+	all, err := tq.GetDescendants(RootPath, tenantID, tenantType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != nodes {
+		t.Fatalf("got %d nodes, want %d", len(all), nodes)
+	}
+	if issues := NewTree(all).Check(); len(issues) > 0 {
+		t.Fatalf("tree is inconsistent after %d moves: %v", moved, issues)
+	}
+}
@@ -0,0 +1,121 @@
+package materialized
+
+import (
+	"gorm.io/gorm"
+)
+
+// SearchResult is the result of SearchTree
+type SearchResult struct {
+	// Root is the search root with the matches and the ancestors connecting them
+	Root *TreeNode `json:"root"`
+
+	// Total is the number of matching nodes, which may exceed the matches in the
+	// tree when a Limit option was given
+	Total int64 `json:"total"`
+
+	// Truncated reports whether matches were left out because of the limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// GetAncestorsUnionQuery returns a query builder for the nodes on the way from
+// the node at fromPath down to any of the given nodes, both ends included
+func (tq *TreeQuery) GetAncestorsUnionQuery(
+	tx *gorm.DB,
+	nodePaths []Path,
+	fromPath Path,
+	tenantID,
+	tenantType string,
+) *gorm.DB {
+	seen := make(map[Path]bool)
+	paths := []Path{fromPath}
+	seen[fromPath] = true
+	for _, nodePath := range nodePaths {
+		for _, ancestorPath := range ancestorPaths(nodePath, fromPath.Depth()) {
+			if !seen[ancestorPath] {
+				seen[ancestorPath] = true
+				paths = append(paths, ancestorPath)
+			}
+		}
+	}
+
+	return tq.scoped(tx, tenantID, tenantType).
+		Where("path IN (?)", paths)
+}
+
+// SearchTree searches the subtree at subtreePath for nodes whose name contains
+// query and returns them as a pruned tree: the matches plus every ancestor needed
+// to connect them to the search root, which is what a filterable tree sidebar shows.
+// Matches are flagged with Matched and every node carries the number of matches
+// at or below it in MatchCount. Searching at RootPath works without a root row,
+// see GetSubtreeNested.
+//
+// Options filter the matches like they filter Find, e.g. MatchBy, IgnoreCase,
+// OwnedBy, MaxRelativeDepth or Limit to cap the number of matches. Ordering and
+// cursor options are ignored.
+func (tq *TreeQuery) SearchTree(
+	query string,
+	subtreePath Path,
+	tenantID,
+	tenantType string,
+	opts ...FindOption,
+) (*SearchResult, error) {
+	o := newFindOptions(append([]FindOption{NameMatches(query)}, opts...))
+	o.subtree = &subtreePath
+	o.order = OrderPath
+	o.desc = false
+	o.cursor = ""
+
+	page, err := tq.find(tq.db, Tenant{tenantID, tenantType}, o)
+	if err != nil {
+		return nil, err
+	}
+
+	matchPaths := make([]Path, len(page.Nodes))
+	for i, match := range page.Nodes {
+		matchPaths[i] = match.Path
+	}
+
+	var skeleton []*TreeNode
+	if err := tq.GetAncestorsUnionQuery(tq.db, matchPaths, subtreePath, tenantID, tenantType).
+		Find(&skeleton).Error; err != nil {
+		return nil, err
+	}
+
+	// Matches are used as loaded, their rows among the ancestors are skipped
+	byPath := make(map[Path]*TreeNode, len(skeleton)+len(page.Nodes))
+	nodes := make([]*TreeNode, 0, len(skeleton)+len(page.Nodes))
+	for _, match := range page.Nodes {
+		match.Matched = true
+		byPath[match.Path] = match
+		nodes = append(nodes, match)
+	}
+
+	for _, node := range skeleton {
+		if _, isMatch := byPath[node.Path]; isMatch {
+			continue
+		}
+		byPath[node.Path] = node
+		nodes = append(nodes, node)
+	}
+
+	// At RootPath the root may be virtual, without a row among the ancestors
+	root, err := nestNodes(nodes, subtreePath, nestedSortKeys)
+	if err != nil {
+		return nil, err
+	}
+	byPath[root.Path] = root
+
+	for _, matchPath := range matchPaths {
+		for _, ancestorPath := range ancestorPaths(matchPath, subtreePath.Depth()) {
+			if node, ok := byPath[ancestorPath]; ok {
+				node.MatchCount++
+			}
+		}
+	}
+
+	return &SearchResult{
+		Root:      root,
+		Total:     page.Total,
+		Truncated: page.Total > int64(len(page.Nodes)),
+	}, nil
+}
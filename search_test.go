@@ -0,0 +1,176 @@
+package materialized
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSearchTreeVirtualRoot(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	a1 := mustCreate(t, tq, "match one", a.Path, "t1", "org")
+	mustCreate(t, tq, "match two", a1.Path, "t1", "org")
+	mustCreate(t, tq, "b", RootPath, "t1", "org")
+	mustCreate(t, tq, "match other tenant", RootPath, "t2", "org")
+
+	result, err := tq.SearchTree("match", RootPath, "t1", "org")
+	if err != nil {
+		t.Fatalf("search without a root row: %v", err)
+	}
+	if result.Total != 2 {
+		t.Fatalf("got total %d, want 2", result.Total)
+	}
+
+	root := result.Root
+	if root.Path != RootPath || root.MatchCount != 2 {
+		t.Fatalf("got root %s with %d matches, want the virtual root with 2", root.Path, root.MatchCount)
+	}
+	if len(root.Children) != 1 || root.Children[0].Code != a.Code || root.Children[0].Matched {
+		t.Fatalf("got top level %+v, want the unmatched ancestor a", root.Children)
+	}
+
+	one := root.Children[0].Children
+	if len(one) != 1 || !one[0].Matched || one[0].MatchCount != 2 {
+		t.Fatalf("got %+v, want the first match counting both", one)
+	}
+	if two := one[0].Children; len(two) != 1 || !two[0].Matched || two[0].MatchCount != 1 {
+		t.Fatalf("got %+v, want the second match", two)
+	}
+}
+
+func TestNameMatchesEscapesWildcards(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	for _, name := range []string{"100%", "100 percent", "a_b", "axb", "x!y", "50!%"} {
+		mustCreate(t, tq, name, RootPath, "t1", "org")
+	}
+	mustCreate(t, tq, "a_b", RootPath, "t2", "org")
+
+	tests := []struct {
+		name string
+		opts []FindOption
+		want string
+	}{
+		{"contains percent", []FindOption{NameMatches("100%")}, "100%"},
+		{"contains underscore", []FindOption{NameMatches("_")}, "a_b"},
+		{"contains escape character", []FindOption{NameMatches("!")}, "50!%,x!y"},
+		{"contains escaped percent", []FindOption{NameMatches("!%")}, "50!%"},
+		{"prefix percent", []FindOption{NameMatches("100%"), MatchBy(MatchPrefix)}, "100%"},
+		{"prefix underscore", []FindOption{NameMatches("a_"), MatchBy(MatchPrefix)}, "a_b"},
+		{"prefix escape character", []FindOption{NameMatches("x!"), MatchBy(MatchPrefix)}, "x!y"},
+		{"exact underscore", []FindOption{NameMatches("a_b"), MatchBy(MatchExact)}, "a_b"},
+		{"exact percent", []FindOption{NameMatches("a%"), MatchBy(MatchExact)}, ""},
+		{"exact ignoring case", []FindOption{NameMatches("A_B"), MatchBy(MatchExact), IgnoreCase()}, "a_b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]FindOption{OrderBy(OrderName, false)}, tt.opts...)
+			page, err := tq.Find(context.Background(), Tenant{"t1", "org"}, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(page.Nodes); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := tq.Find(context.Background(), Tenant{"t1", "org"}, NameMatches("a"), MatchBy("fuzzy")); err == nil {
+		t.Fatal("got no error for an unsupported match mode")
+	}
+}
+
+func TestSearchNodesRanksExactBeforePrefixBeforeContains(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	mustCreate(t, tq, "my team", RootPath, "t1", "org")
+	mustCreate(t, tq, "teammate", RootPath, "t1", "org")
+	x := mustCreate(t, tq, "x", RootPath, "t1", "org")
+	mustCreate(t, tq, "team b", x.Path, "t1", "org")
+	mustCreate(t, tq, "team", x.Path, "t1", "org")
+	mustCreate(t, tq, "team", RootPath, "t1", "org")
+	mustCreate(t, tq, "team", RootPath, "t2", "org")
+
+	tests := []struct {
+		name  string
+		query string
+		opts  []FindOption
+		want  string
+	}{
+		{"ranked", "team", nil, "team,team,teammate,team b,my team"},
+		{"ranked ignoring case", "TEAM", []FindOption{IgnoreCase()}, "team,team,teammate,team b,my team"},
+		{"prefix mode", "team", []FindOption{MatchBy(MatchPrefix)}, "team,team,teammate,team b"},
+		{"exact mode", "team", []FindOption{MatchBy(MatchExact)}, "team,team"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, total, err := tq.SearchNodes(tt.query, "t1", "org", 10, 0, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(nodes); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+			if total != int64(len(nodes)) {
+				t.Fatalf("got total %d for %d nodes", total, len(nodes))
+			}
+		})
+	}
+
+	// The shallower exact match ranks first
+	nodes, _, err := tq.SearchNodes("team", "t1", "org", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Path.Depth() != 1 {
+		t.Fatalf("got %+v, want the root-level team", nodes)
+	}
+}
+
+func TestMetadataEquals(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	metadata := map[string]Metadata{
+		"a": {"kind": "folder", "color": "red"},
+		"b": {"kind": "folder", "color": "blue"},
+		"c": {"kind": "file", "a.b": "x"},
+		"d": nil,
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		node := mustCreate(t, tq, name, RootPath, "t1", "org")
+		if metadata[name] == nil {
+			continue
+		}
+		if err := tq.UpdateNode(node.Code, "t1", "org", map[string]interface{}{"metadata": metadata[name]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	other := mustCreate(t, tq, "other", RootPath, "t2", "org")
+	if err := tq.UpdateNode(other.Code, "t2", "org", map[string]interface{}{"metadata": Metadata{"kind": "folder"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []FindOption
+		want string
+	}{
+		{"one key", []FindOption{MetadataEquals("kind", "folder")}, "a,b"},
+		{"two keys", []FindOption{MetadataEquals("kind", "folder"), MetadataEquals("color", "blue")}, "b"},
+		{"same key twice", []FindOption{MetadataEquals("color", "blue"), MetadataEquals("color", "red")}, "a"},
+		{"key with a dot", []FindOption{MetadataEquals("a.b", "x")}, "c"},
+		{"missing key", []FindOption{MetadataEquals("size", "big")}, ""},
+		{"other value", []FindOption{MetadataEquals("kind", "link")}, ""},
+		{"with a name", []FindOption{MetadataEquals("kind", "folder"), NameMatches("b")}, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]FindOption{OrderBy(OrderName, false)}, tt.opts...)
+			page, err := tq.Find(context.Background(), Tenant{"t1", "org"}, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(page.Nodes); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
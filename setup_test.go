@@ -0,0 +1,56 @@
+package materialized
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB opens an empty SQLite database in a temporary directory
+func newTestDB(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "tree.db") + "?_busy_timeout=5000&_journal_mode=WAL"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	return db
+}
+
+// newTestTree returns a TreeQuery on a migrated test database
+func newTestTree(t testing.TB, config TableConfig) *TreeQuery {
+	t.Helper()
+
+	tq, err := NewTreeQuery(newTestDB(t), config)
+	if err != nil {
+		t.Fatalf("new tree query: %v", err)
+	}
+	if err := tq.MigrateDefault(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	return tq
+}
+
+// mustCreate creates a node or fails the test
+func mustCreate(t testing.TB, tq *TreeQuery, name string, parentPath Path, tenantID, tenantType string) *TreeNode {
+	t.Helper()
+
+	node, err := tq.CreateNode(name, parentPath, tenantID, tenantType, "owner", "user")
+	if err != nil {
+		t.Fatalf("create %s: %v", name, err)
+	}
+
+	return node
+}
@@ -0,0 +1,208 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetSiblingsQuery returns a query builder for the nodes sharing the node's parent.
+// Siblings are matched on the parent path, so root-level nodes without a
+// parent_id are handled like any other.
+func (tq *TreeQuery) GetSiblingsQuery(
+	tx *gorm.DB,
+	node *TreeNode,
+	tenantID,
+	tenantType string,
+	includeSelf bool,
+) *gorm.DB {
+	query := tq.scoped(tx, tenantID, tenantType)
+
+	if node == nil {
+		query.AddError(errors.New("node is nil"))
+		return query
+	}
+
+	parentPath, err := node.Path.Parent()
+	if err != nil {
+		query.AddError(err)
+		return query
+	}
+
+	query = query.Where("path LIKE ? AND path != ? AND "+depthSQL+" = ?",
+		parentPath.GetPathPrefix(), string(RootPath), node.Path.Depth())
+
+	if !includeSelf {
+		query = query.Where("path != ?", string(node.Path))
+	}
+
+	return query
+}
+
+// GetSiblingsByCodeQuery returns a query builder for the node with the given
+// code and the nodes sharing its parent. The parent is resolved in a subquery,
+// so the node is not read first, and compared with parent_id directly so the
+// parent index is used. Root-level nodes without a parent_id are siblings of
+// each other.
+func (tq *TreeQuery) GetSiblingsByCodeQuery(
+	tx *gorm.DB,
+	code Code,
+	tenantID,
+	tenantType string,
+) *gorm.DB {
+	if err := code.Validate(); err != nil {
+		tx.AddError(fmt.Errorf("invalid code: %w", err))
+		return tx
+	}
+
+	parentID := tq.nodeColumnQuery(tx, "parent_id", code, tenantID, tenantType)
+	rootLevel := tq.nodeColumnQuery(tx, "1", code, tenantID, tenantType).
+		Where("parent_id IS NULL")
+
+	return tq.scoped(tx, tenantID, tenantType).
+		Where("path != ?", string(RootPath)).
+		Where("parent_id = (?) OR (parent_id IS NULL AND EXISTS (?))", parentID, rootLevel)
+}
+
+// nodeColumnQuery returns a subquery selecting a column expression of the node
+// with the given code
+func (tq *TreeQuery) nodeColumnQuery(tx *gorm.DB, column string, code Code, tenantID, tenantType string) *gorm.DB {
+	return tq.scoped(tx.Session(&gorm.Session{NewDB: true}), tenantID, tenantType).
+		Model(&TreeNode{}).
+		Select(column).
+		Where("code = ? AND path != ?", code, string(RootPath))
+}
+
+// siblingKeyset returns the condition selecting the siblings after the node with
+// the given code in keys order, or before it when backwards is set, and the node
+// itself. The node's sort values are read in subqueries.
+func (tq *TreeQuery) siblingKeyset(
+	tx *gorm.DB,
+	code Code,
+	tenantID,
+	tenantType string,
+	keys []string,
+	backwards bool,
+) clause.Expr {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = gorm.Expr("(?)", tq.nodeColumnQuery(tx, key, code, tenantID, tenantType))
+	}
+
+	return gorm.Expr("(? OR code = ?)", keysetCondition(keys, values, backwards), code)
+}
+
+// GetSiblings retrieves the nodes sharing the parent of the node with the given
+// code, ordered by position, in a single query
+func (tq *TreeQuery) GetSiblings(
+	code Code,
+	tenantID,
+	tenantType string,
+	includeSelf bool,
+) ([]*TreeNode, error) {
+	var nodes []*TreeNode
+	result := tq.GetSiblingsByCodeQuery(tq.db, code, tenantID, tenantType).
+		Order("position, code").
+		Find(&nodes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	// The node is among its own siblings unless it does not exist
+	found := false
+	siblings := make([]*TreeNode, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Code == code {
+			found = true
+			if !includeSelf {
+				continue
+			}
+		}
+		siblings = append(siblings, node)
+	}
+
+	if !found {
+		return nil, ErrUnauthorized
+	}
+
+	return siblings, nil
+}
+
+// GetNextSibling retrieves the sibling following the node in the given order
+// (OrderPosition or OrderName). It returns nil without an error for the last sibling.
+func (tq *TreeQuery) GetNextSibling(code Code, tenantID, tenantType string, order Order) (*TreeNode, error) {
+	return tq.adjacentSibling(code, tenantID, tenantType, order, false)
+}
+
+// GetPreviousSibling retrieves the sibling preceding the node in the given order
+// (OrderPosition or OrderName). It returns nil without an error for the first sibling.
+func (tq *TreeQuery) GetPreviousSibling(code Code, tenantID, tenantType string, order Order) (*TreeNode, error) {
+	return tq.adjacentSibling(code, tenantID, tenantType, order, true)
+}
+
+// adjacentSibling reads the node and the sibling next to it in a single query
+func (tq *TreeQuery) adjacentSibling(
+	code Code,
+	tenantID,
+	tenantType string,
+	order Order,
+	backwards bool,
+) (*TreeNode, error) {
+	keys, err := order.sortKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	direction := " ASC"
+	if backwards {
+		direction = " DESC"
+	}
+
+	query := tq.GetSiblingsByCodeQuery(tq.db, code, tenantID, tenantType).
+		Where(tq.siblingKeyset(tq.db, code, tenantID, tenantType, keys, backwards))
+	for _, key := range keys {
+		query = query.Order(key + direction)
+	}
+
+	// The node sorts first, followed by its neighbour
+	var nodes []*TreeNode
+	if err := query.Limit(2).Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 || nodes[0].Code != code {
+		return nil, ErrUnauthorized
+	}
+	if len(nodes) == 1 {
+		return nil, nil
+	}
+
+	return nodes[1], nil
+}
+
+// GetSiblingIndex returns the zero-based index of the node among its siblings
+// in the given order (OrderPosition or OrderName), counted in a single query
+func (tq *TreeQuery) GetSiblingIndex(code Code, tenantID, tenantType string, order Order) (int, error) {
+	keys, err := order.sortKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	// The count includes the node itself, so it is zero only for a missing node
+	var count int64
+	result := tq.GetSiblingsByCodeQuery(tq.db, code, tenantID, tenantType).
+		Model(&TreeNode{}).
+		Where(tq.siblingKeyset(tq.db, code, tenantID, tenantType, keys, true)).
+		Count(&count)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	if count == 0 {
+		return 0, ErrUnauthorized
+	}
+
+	return int(count) - 1, nil
+}
@@ -0,0 +1,140 @@
+package materialized
+
+import (
+	"strings"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// countQueries counts the SELECT statements sent to the database, leaving out
+// subqueries that are only built
+func countQueries(t *testing.T, db *gorm.DB) *int {
+	t.Helper()
+
+	n := new(int)
+	if err := db.Callback().Query().After("gorm:query").Register("test:count", func(tx *gorm.DB) {
+		if !tx.DryRun {
+			*n++
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestSiblingsSingleQuery(t *testing.T) {
+	config := DefaultTableConfig()
+	tq := newTestTree(t, config)
+	if err := tq.db.Use(NewTenantGuard(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	parent := mustCreate(t, tq, "parent", RootPath, "t1", "org")
+	var children []*TreeNode
+	for _, name := range []string{"c", "a", "b"} {
+		children = append(children, mustCreate(t, tq, name, parent.Path, "t1", "org"))
+	}
+	mustCreate(t, tq, "other", RootPath, "t1", "org")
+	mustCreate(t, tq, "nested", children[0].Path, "t1", "org")
+
+	queries := countQueries(t, tq.db)
+	a, b, c := children[1], children[2], children[0]
+
+	siblings, err := tq.GetSiblings(a.Code, "t1", "org", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(siblings) != 2 || siblings[0].Code != c.Code || siblings[1].Code != b.Code {
+		t.Fatalf("got siblings %+v, want c and b", siblings)
+	}
+
+	next, err := tq.GetNextSibling(a.Code, "t1", "org", OrderName)
+	if err != nil || next == nil || next.Code != b.Code {
+		t.Fatalf("got next %+v, %v, want b", next, err)
+	}
+	previous, err := tq.GetPreviousSibling(b.Code, "t1", "org", OrderName)
+	if err != nil || previous == nil || previous.Code != a.Code {
+		t.Fatalf("got previous %+v, %v, want a", previous, err)
+	}
+	last, err := tq.GetNextSibling(c.Code, "t1", "org", OrderName)
+	if err != nil || last != nil {
+		t.Fatalf("got %+v, %v after the last sibling, want nil", last, err)
+	}
+
+	index, err := tq.GetSiblingIndex(c.Code, "t1", "org", OrderName)
+	if err != nil || index != 2 {
+		t.Fatalf("got index %d, %v, want 2", index, err)
+	}
+
+	if *queries != 5 {
+		t.Fatalf("ran %d queries for 5 calls", *queries)
+	}
+
+	// Root-level nodes are siblings of each other
+	top, err := tq.GetSiblings(parent.Code, "t1", "org", true)
+	if err != nil || len(top) != 2 {
+		t.Fatalf("got %d root-level siblings, %v, want 2", len(top), err)
+	}
+}
+
+func TestSiblingsMissingNode(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	node := mustCreate(t, tq, "a", RootPath, "t1", "org")
+
+	// Another tenant's node does not exist for this one
+	if _, err := tq.GetSiblings(node.Code, "t2", "org", true); err != ErrUnauthorized {
+		t.Fatalf("siblings: got %v, want ErrUnauthorized", err)
+	}
+	if _, err := tq.GetNextSibling(node.Code, "t2", "org", OrderPosition); err != ErrUnauthorized {
+		t.Fatalf("next: got %v, want ErrUnauthorized", err)
+	}
+	if _, err := tq.GetSiblingIndex(node.Code, "t2", "org", OrderPosition); err != ErrUnauthorized {
+		t.Fatalf("index: got %v, want ErrUnauthorized", err)
+	}
+
+	if err := tq.DeleteNode(node.Path, "t1", "org", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tq.GetSiblings(node.Code, "t1", "org", true); err != ErrUnauthorized {
+		t.Fatalf("deleted node: got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSiblingsUseParentIndex(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	var node *TreeNode
+	for i := 0; i < 20; i++ {
+		parent := mustCreate(t, tq, "parent", RootPath, "t1", "org")
+		for j := 0; j < 5; j++ {
+			node = mustCreate(t, tq, "child", parent.Path, "t1", "org")
+		}
+	}
+	if err := CrossTenant(tq.db).Exec("ANALYZE").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []*TreeNode
+	stmt := tq.GetSiblingsByCodeQuery(tq.db.Session(&gorm.Session{DryRun: true}), node.Code, "t1", "org").
+		Find(&rows).Statement
+	sql := tq.db.Dialector.Explain(stmt.SQL.String(), stmt.Vars...)
+
+	var plan []struct{ Detail string }
+	if err := CrossTenant(tq.db).Raw("EXPLAIN QUERY PLAN " + sql).Scan(&plan).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range plan {
+		if strings.HasPrefix(step.Detail, "SCAN tree_nodes") {
+			t.Fatalf("siblings scan the table: %+v", plan)
+		}
+	}
+	for _, step := range plan {
+		if strings.Contains(step.Detail, "idx_parent_id") {
+			return
+		}
+	}
+	t.Fatalf("siblings do not use the parent index: %+v", plan)
+}
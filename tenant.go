@@ -0,0 +1,396 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNoTenant is returned when no tenant can be resolved from a context
+	ErrNoTenant = errors.New("no tenant in context")
+)
+
+// Tenant identifies the tree a TenantTree operates on.
+// Using named fields instead of positional strings keeps the ID and type from being swapped.
+type Tenant struct {
+	ID   string
+	Type string
+}
+
+// IsZero reports whether the tenant is unset
+func (t Tenant) IsZero() bool {
+	return t.ID == "" && t.Type == ""
+}
+
+// Fields returns the tenant as the TenantFields stored on each node
+func (t Tenant) Fields() TenantFields {
+	return TenantFields{ID: t.ID, Type: t.Type}
+}
+
+// TenantExtractor resolves the tenant a request acts on from its context
+type TenantExtractor func(ctx context.Context) (Tenant, error)
+
+type tenantContextKey struct{}
+
+// ContextWithTenant returns a copy of ctx carrying the tenant
+func ContextWithTenant(ctx context.Context, tenant Tenant) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant stored by ContextWithTenant.
+// It is the default TenantExtractor.
+func TenantFromContext(ctx context.Context) (Tenant, error) {
+	tenant, ok := ctx.Value(tenantContextKey{}).(Tenant)
+	if !ok || tenant.IsZero() {
+		return Tenant{}, ErrNoTenant
+	}
+
+	return tenant, nil
+}
+
+// WithTenantExtractor returns a TreeQuery that resolves tenants in ForContext using extractor
+func (tq *TreeQuery) WithTenantExtractor(extractor TenantExtractor) *TreeQuery {
+	c := tq.clone(tq.db)
+	c.tenantExtractor = extractor
+	return c
+}
+
+// ForTenant returns a handle whose operations are bound to the given tenant
+func (tq *TreeQuery) ForTenant(tenant Tenant) *TenantTree {
+	return &TenantTree{
+		tq:     tq,
+		tenant: tenant,
+	}
+}
+
+// ForContext resolves the tenant from ctx with the configured extractor and
+// returns a handle bound to both the tenant and the context
+func (tq *TreeQuery) ForContext(ctx context.Context) (*TenantTree, error) {
+	extractor := tq.tenantExtractor
+	if extractor == nil {
+		extractor = TenantFromContext
+	}
+
+	tenant, err := extractor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if tenant.IsZero() {
+		return nil, ErrNoTenant
+	}
+
+	return tq.WithContext(ctx).ForTenant(tenant), nil
+}
+
+// TenantTree exposes the TreeQuery operations for a single tenant.
+// The tenant is supplied once, when the handle is created, instead of on every call.
+type TenantTree struct {
+	tq     *TreeQuery
+	tenant Tenant
+}
+
+// Tenant returns the tenant the handle is bound to
+func (tt *TenantTree) Tenant() Tenant {
+	return tt.tenant
+}
+
+// TreeQuery returns the underlying TreeQuery
+func (tt *TenantTree) TreeQuery() *TreeQuery {
+	return tt.tq
+}
+
+// WithContext returns a handle whose queries run with the given context
+func (tt *TenantTree) WithContext(ctx context.Context) *TenantTree {
+	return tt.tq.WithContext(ctx).ForTenant(tt.tenant)
+}
+
+// WithTransaction returns a handle that executes operations within an existing transaction
+func (tt *TenantTree) WithTransaction(tx *gorm.DB) *TenantTree {
+	return tt.tq.WithTransaction(tx).ForTenant(tt.tenant)
+}
+
+// WithLockHolder returns a handle whose mutations are not blocked by the subtree locks of holder
+func (tt *TenantTree) WithLockHolder(holder string) *TenantTree {
+	return tt.tq.WithLockHolder(holder).ForTenant(tt.tenant)
+}
+
+// GetNodeByCode retrieves a node by its code
+func (tt *TenantTree) GetNodeByCode(code Code) (*TreeNode, error) {
+	return tt.tq.GetNodeByCode(code, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetNodeByID retrieves a node by its ID
+func (tt *TenantTree) GetNodeByID(id any) (*TreeNode, error) {
+	return tt.tq.GetNodeByID(id, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetNodeByPath retrieves a node by its path
+func (tt *TenantTree) GetNodeByPath(path Path) (*TreeNode, error) {
+	return tt.tq.GetNodeByPath(path, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetParentByNode retrieves the parent of the given node
+func (tt *TenantTree) GetParentByNode(node *TreeNode) (*TreeNode, error) {
+	return tt.tq.GetParentByNode(node, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetParentByCode retrieves the parent of a node by its code
+func (tt *TenantTree) GetParentByCode(code Code) (*TreeNode, error) {
+	return tt.tq.GetParentByCode(code, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetParentByID retrieves the parent of a node by its ID
+func (tt *TenantTree) GetParentByID(id any) (*TreeNode, error) {
+	return tt.tq.GetParentByID(id, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetParentByPath retrieves the parent of a node by its path
+func (tt *TenantTree) GetParentByPath(nodePath Path) (*TreeNode, error) {
+	return tt.tq.GetParentByPath(nodePath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetChildrenByParentID retrieves all direct children of a node
+func (tt *TenantTree) GetChildrenByParentID(code *Code) ([]*TreeNode, error) {
+	return tt.tq.GetChildrenByParentID(code, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetChildrenByCode retrieves all direct children of a node by its code
+func (tt *TenantTree) GetChildrenByCode(code Code) ([]*TreeNode, error) {
+	return tt.tq.GetChildrenByCode(code, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetChildrenByPath retrieves all direct children of a node by its path
+func (tt *TenantTree) GetChildrenByPath(parentPath Path) ([]*TreeNode, error) {
+	return tt.tq.GetChildrenByPath(parentPath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetDescendants retrieves all descendants of a node
+func (tt *TenantTree) GetDescendants(parentPath Path) ([]*TreeNode, error) {
+	return tt.tq.GetDescendants(parentPath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetAncestors retrieves all ancestors of a node
+func (tt *TenantTree) GetAncestors(nodePath Path) ([]*TreeNode, error) {
+	return tt.tq.GetAncestors(nodePath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetAncestorsNested retrieves all ancestors of a node in a nested structure
+func (tt *TenantTree) GetAncestorsNested(nodePath Path) (*TreeNode, error) {
+	return tt.tq.GetAncestorsNested(nodePath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// CreateNode creates a new node in the tree
+func (tt *TenantTree) CreateNode(name string, parentPath Path, ownerID, ownerType string, opts ...CreateOption) (*TreeNode, error) {
+	return tt.tq.CreateNode(name, parentPath, tt.tenant.ID, tt.tenant.Type, ownerID, ownerType, opts...)
+}
+
+// UpdateNode updates a node's properties
+func (tt *TenantTree) UpdateNode(code Code, updates map[string]interface{}) error {
+	return tt.tq.UpdateNode(code, tt.tenant.ID, tt.tenant.Type, updates)
+}
+
+// MoveNode moves a node and all its descendants to a new parent
+func (tt *TenantTree) MoveNode(nodePath, newParentPath Path) error {
+	return tt.tq.MoveNode(nodePath, newParentPath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// DeleteNode deletes a node and optionally its descendants
+func (tt *TenantTree) DeleteNode(nodePath Path, deleteDescendants bool) error {
+	return tt.tq.DeleteNode(nodePath, tt.tenant.ID, tt.tenant.Type, deleteDescendants)
+}
+
+// SearchNodes searches for nodes by name, ranked by relevance
+func (tt *TenantTree) SearchNodes(query string, limit, offset int, opts ...FindOption) ([]*TreeNode, int64, error) {
+	return tt.tq.SearchNodes(query, tt.tenant.ID, tt.tenant.Type, limit, offset, opts...)
+}
+
+// GetNodesByOwner retrieves nodes associated with a specific owner
+func (tt *TenantTree) GetNodesByOwner(ownerID, ownerType string, limit, offset int) ([]*TreeNode, int64, error) {
+	return tt.tq.GetNodesByOwner(ownerID, ownerType, tt.tenant.ID, tt.tenant.Type, limit, offset)
+}
+
+// GetNodesByDepth retrieves nodes at a specific depth in the tree
+func (tt *TenantTree) GetNodesByDepth(depth int) ([]*TreeNode, error) {
+	return tt.tq.GetNodesByDepth(depth, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetRootNode retrieves the root node, creating it if it doesn't exist
+func (tt *TenantTree) GetRootNode() (*TreeNode, error) {
+	return tt.tq.GetRootNode(tt.tenant.ID, tt.tenant.Type)
+}
+
+// BatchCreateNodes creates multiple nodes in a single transaction
+func (tt *TenantTree) BatchCreateNodes(
+	nodes []struct {
+		Name       string
+		ParentPath Path
+		OwnerID    string
+		OwnerType  string
+	},
+) ([]*TreeNode, error) {
+	return tt.tq.BatchCreateNodes(nodes, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetNodeWithChildrenByPath retrieves a node with a page of its direct children by path
+func (tt *TenantTree) GetNodeWithChildrenByPath(path Path, limit, offset int) (*TreeNode, int64, error) {
+	return tt.tq.GetNodeWithChildrenByPath(path, tt.tenant.ID, tt.tenant.Type, limit, offset)
+}
+
+// GetNodeWithChildrenByCode retrieves a node with a page of its direct children by code
+func (tt *TenantTree) GetNodeWithChildrenByCode(code Code, limit, offset int) (*TreeNode, int64, error) {
+	return tt.tq.GetNodeWithChildrenByCode(code, tt.tenant.ID, tt.tenant.Type, limit, offset)
+}
+
+// Find retrieves a page of nodes matching the options
+func (tt *TenantTree) Find(ctx context.Context, opts ...FindOption) (*Page, error) {
+	return tt.tq.Find(ctx, tt.tenant, opts...)
+}
+
+// GetChildrenByCodePage retrieves a page of direct children of a node ordered by position
+func (tt *TenantTree) GetChildrenByCodePage(code Code, limit int, cursor string) (*Page, error) {
+	return tt.tq.GetChildrenByCodePage(code, tt.tenant.ID, tt.tenant.Type, limit, cursor)
+}
+
+// GetDescendantsPage retrieves a page of descendants of a node in depth-first order
+func (tt *TenantTree) GetDescendantsPage(parentPath Path, limit int, cursor string) (*Page, error) {
+	return tt.tq.GetDescendantsPage(parentPath, tt.tenant.ID, tt.tenant.Type, limit, cursor)
+}
+
+// SearchNodesPage searches for nodes by name, returning a page in creation order
+func (tt *TenantTree) SearchNodesPage(query string, limit int, cursor string) (*Page, error) {
+	return tt.tq.SearchNodesPage(query, tt.tenant.ID, tt.tenant.Type, limit, cursor)
+}
+
+// GetNodesByOwnerPage retrieves a page of nodes associated with a specific owner in creation order
+func (tt *TenantTree) GetNodesByOwnerPage(ownerID, ownerType string, limit int, cursor string) (*Page, error) {
+	return tt.tq.GetNodesByOwnerPage(ownerID, ownerType, tt.tenant.ID, tt.tenant.Type, limit, cursor)
+}
+
+// IterDescendants streams the descendants of a node in batches
+func (tt *TenantTree) IterDescendants(ctx context.Context, parentPath Path, opts ...IterOption) iter.Seq2[*TreeNode, error] {
+	return tt.tq.IterDescendants(ctx, parentPath, tt.tenant, opts...)
+}
+
+// GetSubtreeNested retrieves a node with its descendants nested up to maxDepth levels
+func (tt *TenantTree) GetSubtreeNested(nodePath Path, maxDepth int) (*TreeNode, error) {
+	return tt.tq.GetSubtreeNested(nodePath, tt.tenant.ID, tt.tenant.Type, maxDepth)
+}
+
+// GetSiblings retrieves the nodes sharing the parent of the node with the given code
+func (tt *TenantTree) GetSiblings(code Code, includeSelf bool) ([]*TreeNode, error) {
+	return tt.tq.GetSiblings(code, tt.tenant.ID, tt.tenant.Type, includeSelf)
+}
+
+// GetNextSibling retrieves the sibling following the node in the given order
+func (tt *TenantTree) GetNextSibling(code Code, order Order) (*TreeNode, error) {
+	return tt.tq.GetNextSibling(code, tt.tenant.ID, tt.tenant.Type, order)
+}
+
+// GetPreviousSibling retrieves the sibling preceding the node in the given order
+func (tt *TenantTree) GetPreviousSibling(code Code, order Order) (*TreeNode, error) {
+	return tt.tq.GetPreviousSibling(code, tt.tenant.ID, tt.tenant.Type, order)
+}
+
+// GetSiblingIndex returns the zero-based index of the node among its siblings
+func (tt *TenantTree) GetSiblingIndex(code Code, order Order) (int, error) {
+	return tt.tq.GetSiblingIndex(code, tt.tenant.ID, tt.tenant.Type, order)
+}
+
+// GetPathBetween retrieves the chain of nodes between two nodes through their lowest common ancestor
+func (tt *TenantTree) GetPathBetween(codeA, codeB Code) ([]*TreeNode, error) {
+	return tt.tq.GetPathBetween(codeA, codeB, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetLeaves retrieves the descendants of a node that have no children
+func (tt *TenantTree) GetLeaves(subtreePath Path) ([]*TreeNode, error) {
+	return tt.tq.GetLeaves(subtreePath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetBranches retrieves the descendants of a node that have children
+func (tt *TenantTree) GetBranches(subtreePath Path) ([]*TreeNode, error) {
+	return tt.tq.GetBranches(subtreePath, tt.tenant.ID, tt.tenant.Type)
+}
+
+// ExpandTo retrieves the tree from the root down to a node with each level's children loaded
+func (tt *TenantTree) ExpandTo(code Code, childLimit int) (*Expansion, error) {
+	return tt.tq.ExpandTo(code, tt.tenant.ID, tt.tenant.Type, childLimit)
+}
+
+// SearchTree searches a subtree and returns the matches as a pruned tree
+func (tt *TenantTree) SearchTree(query string, subtreePath Path, opts ...FindOption) (*SearchResult, error) {
+	return tt.tq.SearchTree(query, subtreePath, tt.tenant.ID, tt.tenant.Type, opts...)
+}
+
+// MatchPath retrieves the nodes whose path matches the pattern
+func (tt *TenantTree) MatchPath(pattern string) ([]*TreeNode, error) {
+	return tt.tq.MatchPath(pattern, tt.tenant.ID, tt.tenant.Type)
+}
+
+// UpdateNodeIfVersion updates a node's properties if its version is still expectedVersion
+func (tt *TenantTree) UpdateNodeIfVersion(code Code, expectedVersion int64, updates map[string]interface{}) (*TreeNode, error) {
+	return tt.tq.UpdateNodeIfVersion(code, tt.tenant.ID, tt.tenant.Type, expectedVersion, updates)
+}
+
+// MoveNodeIfVersion moves a node to a new parent if its version is still expectedVersion
+func (tt *TenantTree) MoveNodeIfVersion(code Code, newParentPath Path, expectedVersion int64) (*TreeNode, error) {
+	return tt.tq.MoveNodeIfVersion(code, newParentPath, tt.tenant.ID, tt.tenant.Type, expectedVersion)
+}
+
+// LockSubtree locks a node and its descendants for holder until ttl has passed
+func (tt *TenantTree) LockSubtree(code Code, holder string, ttl time.Duration) (*SubtreeLock, error) {
+	return tt.tq.LockSubtree(code, tt.tenant.ID, tt.tenant.Type, holder, ttl)
+}
+
+// UnlockSubtree releases the lock holder has on a node
+func (tt *TenantTree) UnlockSubtree(code Code, holder string) error {
+	return tt.tq.UnlockSubtree(code, tt.tenant.ID, tt.tenant.Type, holder)
+}
+
+// GetSubtreeLocks retrieves the live subtree locks
+func (tt *TenantTree) GetSubtreeLocks() ([]*SubtreeLock, error) {
+	return tt.tq.GetSubtreeLocks(tt.tenant.ID, tt.tenant.Type)
+}
+
+// ImportNodes creates multiple nodes in a single transaction, keeping their assigned codes
+func (tt *TenantTree) ImportNodes(nodes []BatchNode) ([]*TreeNode, error) {
+	return tt.tq.ImportNodes(nodes, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetNodeByIdempotencyKey retrieves the node created with an idempotency key
+func (tt *TenantTree) GetNodeByIdempotencyKey(key string) (*TreeNode, error) {
+	return tt.tq.GetNodeByIdempotencyKey(key, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetNodeHistory retrieves the history of a node, oldest entry first
+func (tt *TenantTree) GetNodeHistory(code Code) ([]*NodeHistory, error) {
+	return tt.tq.GetNodeHistory(code, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetSubtreeHistory retrieves the history of the nodes at or below path since the given time
+func (tt *TenantTree) GetSubtreeHistory(path Path, since time.Time) ([]*NodeHistory, error) {
+	return tt.tq.GetSubtreeHistory(path, since, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetNodeByCodeAsOf retrieves a node as it was at t
+func (tt *TenantTree) GetNodeByCodeAsOf(code Code, t time.Time) (*TreeNode, error) {
+	return tt.tq.GetNodeByCodeAsOf(code, t, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetDescendantsAsOf retrieves the descendants the node at parentPath had at t
+func (tt *TenantTree) GetDescendantsAsOf(parentPath Path, t time.Time) ([]*TreeNode, error) {
+	return tt.tq.GetDescendantsAsOf(parentPath, t, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetAncestorsAsOf retrieves the nodes on nodePath at t
+func (tt *TenantTree) GetAncestorsAsOf(nodePath Path, t time.Time) ([]*TreeNode, error) {
+	return tt.tq.GetAncestorsAsOf(nodePath, t, tt.tenant.ID, tt.tenant.Type)
+}
+
+// GetChildrenByCodeAsOf retrieves the direct children a node had at t
+func (tt *TenantTree) GetChildrenByCodeAsOf(code Code, t time.Time) ([]*TreeNode, error) {
+	return tt.tq.GetChildrenByCodeAsOf(code, t, tt.tenant.ID, tt.tenant.Type)
+}
@@ -0,0 +1,156 @@
+package materialized
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestTenantTreeIsScopedToItsTenant(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	t1 := tq.ForTenant(Tenant{"t1", "org"})
+	t2 := tq.ForTenant(Tenant{"t2", "org"})
+
+	if got := t1.Tenant(); got != (Tenant{"t1", "org"}) {
+		t.Fatalf("got tenant %+v", got)
+	}
+	if t1.TreeQuery() != tq {
+		t.Fatal("got another TreeQuery")
+	}
+
+	a, err := t1.CreateNode("a", RootPath, "owner", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Tenant != (Tenant{"t1", "org"}).Fields() {
+		t.Fatalf("created in %+v, want t1/org", a.Tenant)
+	}
+	child, err := t1.CreateNode("child", a.Path, "owner", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := t2.CreateNode("b", RootPath, "owner", "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other tenants, and the tenant with ID and type swapped, see none of it
+	for _, other := range []*TenantTree{t2, tq.ForTenant(Tenant{"org", "t1"}), tq.ForTenant(Tenant{"t1", "team"})} {
+		if _, err := other.GetNodeByCode(a.Code); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("%+v: got %v, want ErrUnauthorized", other.Tenant(), err)
+		}
+		if err := other.UpdateNode(a.Code, map[string]interface{}{"name": "taken"}); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("%+v: update got %v, want ErrUnauthorized", other.Tenant(), err)
+		}
+		if err := other.DeleteNode(a.Path, true); err == nil {
+			t.Fatalf("%+v: deleted another tenant's node", other.Tenant())
+		}
+	}
+
+	descendants, err := t1.GetDescendants(a.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(descendants); got != "child" {
+		t.Fatalf("got descendants %s, want child", got)
+	}
+
+	page, err := t1.Find(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(page.Nodes); got != "a,child" {
+		t.Fatalf("found %s, want a,child", got)
+	}
+
+	if err := t1.UpdateNode(child.Code, map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := t1.GetNodeByCode(child.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "renamed" {
+		t.Fatalf("got %s, want renamed", got.Name)
+	}
+}
+
+func TestTenantTreeWithContext(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	tenant := tq.ForTenant(Tenant{"t1", "org"})
+	a, err := tenant.CreateNode("a", RootPath, "owner", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	cancelled := tenant.WithContext(ctx)
+	if cancelled.Tenant() != tenant.Tenant() {
+		t.Fatalf("got tenant %+v", cancelled.Tenant())
+	}
+	if _, err := cancelled.GetNodeByCode(a.Code); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	// The handle it was derived from is unaffected
+	if _, err := tenant.GetNodeByCode(a.Code); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForContext(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	errLookup := errors.New("no session")
+
+	tests := []struct {
+		name      string
+		extractor TenantExtractor
+		ctx       context.Context
+		err       error
+	}{
+		{"no tenant", nil, context.Background(), ErrNoTenant},
+		{"zero tenant", nil, ContextWithTenant(context.Background(), Tenant{}), ErrNoTenant},
+		{"tenant in the context", nil, ContextWithTenant(context.Background(), Tenant{"t1", "org"}), nil},
+		{"extractor error", func(context.Context) (Tenant, error) { return Tenant{}, errLookup }, context.Background(), errLookup},
+		{"extractor without a tenant", func(context.Context) (Tenant, error) { return Tenant{}, nil }, context.Background(), ErrNoTenant},
+		{"extractor", func(context.Context) (Tenant, error) { return Tenant{"t1", "org"}, nil }, context.Background(), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := tq
+			if tt.extractor != nil {
+				source = tq.WithTenantExtractor(tt.extractor)
+			}
+
+			tenant, err := source.ForContext(tt.ctx)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) || tenant != nil {
+					t.Fatalf("got %v, %v, want %v", tenant, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tenant.Tenant() != (Tenant{"t1", "org"}) {
+				t.Fatalf("got tenant %+v", tenant.Tenant())
+			}
+			if _, err := tenant.GetNodeByCode(a.Code); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	// The handle runs its queries with the context the tenant came from
+	ctx, cancel := context.WithCancel(ContextWithTenant(context.Background(), Tenant{"t1", "org"}))
+	tenant, err := tq.ForContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := tenant.GetNodeByCode(a.Code); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v after cancelling the context, want context.Canceled", err)
+	}
+}
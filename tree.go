@@ -0,0 +1,679 @@
+package materialized
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	// SkipChildren is returned by a Walk callback to skip the children of the current node.
+	// It is ignored in post-order walks, where children have already been visited.
+	SkipChildren = errors.New("skip children")
+
+	// StopWalk is returned by a Walk callback to end the walk without an error
+	StopWalk = errors.New("stop walk")
+
+	// ErrNodeNotInTree is returned when a path does not belong to a Tree
+	ErrNodeNotInTree = errors.New("node not in tree")
+)
+
+// WalkOrder controls the order in which Walk visits nodes
+type WalkOrder int
+
+const (
+	// PreOrder visits a node before its children
+	PreOrder WalkOrder = iota
+
+	// PostOrder visits a node after its children
+	PostOrder
+)
+
+// TreeIssueKind identifies a consistency problem found by Tree.Check
+type TreeIssueKind string
+
+const (
+	// IssueOrphan marks a node whose parent is missing from the tree
+	IssueOrphan TreeIssueKind = "orphan"
+
+	// IssueParentMismatch marks a node whose ParentID does not match its path
+	IssueParentMismatch TreeIssueKind = "parent_mismatch"
+
+	// IssuePathMismatch marks a node whose path does not end with its code or is malformed
+	IssuePathMismatch TreeIssueKind = "path_mismatch"
+
+	// IssueDuplicate marks a node whose code or path is already used by another node
+	IssueDuplicate TreeIssueKind = "duplicate"
+)
+
+// TreeIssue describes a consistency problem of a single node
+type TreeIssue struct {
+	Kind   TreeIssueKind
+	Node   *TreeNode
+	Detail string
+}
+
+func (i TreeIssue) String() string {
+	return fmt.Sprintf("%s: %s (%s)", i.Kind, i.Node.Path, i.Detail)
+}
+
+// nodeSnapshot is the persisted state of a node, used to compute mutations
+type nodeSnapshot struct {
+	parentCode Code
+	name       string
+	position   int
+	owner      OwnerFields
+}
+
+// Tree is an in-memory index over a set of nodes, typically a subtree loaded
+// with GetDescendants or GetSubtreeNested. Nodes are indexed by code and path,
+// and parent/child relations are derived from paths.
+//
+// Tree is not safe for concurrent use.
+type Tree struct {
+	nodes    []*TreeNode
+	byCode   map[Code]*TreeNode
+	byPath   map[Path]*TreeNode
+	children map[Path][]*TreeNode
+	issues   []TreeIssue
+
+	// baseline holds the state the nodes were loaded with, keyed by code
+	baseline map[Code]nodeSnapshot
+}
+
+// NewTree builds a Tree from nodes. Nested Children are flattened into the tree.
+func NewTree(nodes []*TreeNode) *Tree {
+	t := &Tree{}
+	t.index(flattenNodes(nodes))
+
+	t.baseline = make(map[Code]nodeSnapshot, len(t.nodes))
+	for _, node := range t.nodes {
+		if node.Code != "" {
+			t.baseline[node.Code] = snapshotNode(node)
+		}
+	}
+
+	return t
+}
+
+// flattenNodes returns nodes and their nested children in pre-order
+func flattenNodes(nodes []*TreeNode) []*TreeNode {
+	var flat []*TreeNode
+	var visit func(node *TreeNode)
+	visit = func(node *TreeNode) {
+		flat = append(flat, node)
+		for _, child := range node.Children {
+			visit(child)
+		}
+	}
+	for _, node := range nodes {
+		visit(node)
+	}
+
+	return flat
+}
+
+func snapshotNode(node *TreeNode) nodeSnapshot {
+	return nodeSnapshot{
+		parentCode: parentCodeOf(node.Path),
+		name:       node.Name,
+		position:   node.Position,
+		owner:      node.Owner,
+	}
+}
+
+// parentCodeOf returns the code of the parent of the node at path,
+// which is the empty root code for root-level nodes
+func parentCodeOf(path Path) Code {
+	parentPath, err := path.Parent()
+	if err != nil || parentPath.IsRoot() {
+		return ""
+	}
+
+	code, _ := parentPath.GetLastNodeID()
+	return code
+}
+
+// index rebuilds the lookup maps, recording duplicates as issues
+func (t *Tree) index(nodes []*TreeNode) {
+	t.nodes = make([]*TreeNode, 0, len(nodes))
+	t.byCode = make(map[Code]*TreeNode, len(nodes))
+	t.byPath = make(map[Path]*TreeNode, len(nodes))
+	t.children = make(map[Path][]*TreeNode)
+	t.issues = nil
+
+	for _, node := range nodes {
+		if _, exists := t.byPath[node.Path]; exists {
+			t.issues = append(t.issues, TreeIssue{IssueDuplicate, node, "path already in tree"})
+			continue
+		}
+		if node.Code != "" {
+			if _, exists := t.byCode[node.Code]; exists {
+				t.issues = append(t.issues, TreeIssue{IssueDuplicate, node, "code already in tree"})
+				continue
+			}
+			t.byCode[node.Code] = node
+		}
+
+		t.byPath[node.Path] = node
+		t.nodes = append(t.nodes, node)
+
+		if parentPath, err := node.Path.Parent(); err == nil {
+			t.children[parentPath] = append(t.children[parentPath], node)
+		}
+	}
+
+	for _, siblings := range t.children {
+		sortSiblings(siblings)
+	}
+}
+
+// sortSiblings orders nodes by position, then name
+func sortSiblings(nodes []*TreeNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].Position != nodes[j].Position {
+			return nodes[i].Position < nodes[j].Position
+		}
+		return nodes[i].Name < nodes[j].Name
+	})
+}
+
+// Size returns the number of nodes in the tree
+func (t *Tree) Size() int {
+	return len(t.nodes)
+}
+
+// Height returns the number of levels in the tree, zero for an empty tree
+func (t *Tree) Height() int {
+	height := 0
+	for _, root := range t.Roots() {
+		t.walk(root, PreOrder, func(node *TreeNode) error {
+			if h := node.Path.Depth() - root.Path.Depth() + 1; h > height {
+				height = h
+			}
+			return nil
+		})
+	}
+
+	return height
+}
+
+// Nodes returns all nodes of the tree
+func (t *Tree) Nodes() []*TreeNode {
+	return t.nodes
+}
+
+// Get returns the node with the given code, or nil
+func (t *Tree) Get(code Code) *TreeNode {
+	return t.byCode[code]
+}
+
+// GetByPath returns the node at path, or nil
+func (t *Tree) GetByPath(path Path) *TreeNode {
+	return t.byPath[path]
+}
+
+// Roots returns the nodes whose parent is not part of the tree
+func (t *Tree) Roots() []*TreeNode {
+	var roots []*TreeNode
+	for _, node := range t.nodes {
+		parentPath, err := node.Path.Parent()
+		if err != nil || t.byPath[parentPath] == nil {
+			roots = append(roots, node)
+		}
+	}
+	sortSiblings(roots)
+
+	return roots
+}
+
+// Children returns the direct children of the node at path, ordered by position then name
+func (t *Tree) Children(path Path) []*TreeNode {
+	return t.children[path]
+}
+
+// Parent returns the parent of the node at path, or nil when it is not in the tree
+func (t *Tree) Parent(path Path) *TreeNode {
+	parentPath, err := path.Parent()
+	if err != nil {
+		return nil
+	}
+
+	return t.byPath[parentPath]
+}
+
+// Ancestors returns the ancestors of the node at path that are part of the tree,
+// from the top-most down to the direct parent
+func (t *Tree) Ancestors(path Path) []*TreeNode {
+	var ancestors []*TreeNode
+	for depth := 0; depth < path.Depth(); depth++ {
+		ancestorPath, err := path.GetAncestorAtDepth(depth)
+		if err != nil {
+			continue
+		}
+		if ancestor := t.byPath[ancestorPath]; ancestor != nil {
+			ancestors = append(ancestors, ancestor)
+		}
+	}
+
+	return ancestors
+}
+
+// Leaves returns the nodes without children, in pre-order
+func (t *Tree) Leaves() []*TreeNode {
+	var leaves []*TreeNode
+	t.Walk(PreOrder, func(node *TreeNode) error {
+		if len(t.children[node.Path]) == 0 {
+			leaves = append(leaves, node)
+		}
+		return nil
+	})
+
+	return leaves
+}
+
+// Find returns the first node in pre-order for which match returns true, or nil
+func (t *Tree) Find(match func(node *TreeNode) bool) *TreeNode {
+	var found *TreeNode
+	t.Walk(PreOrder, func(node *TreeNode) error {
+		if match(node) {
+			found = node
+			return StopWalk
+		}
+		return nil
+	})
+
+	return found
+}
+
+// Subtree returns a new Tree holding the node at path and its descendants.
+// The nodes are shared with t, and the new tree's baseline is their current state.
+func (t *Tree) Subtree(path Path) (*Tree, error) {
+	top := t.byPath[path]
+	if top == nil {
+		return nil, ErrNodeNotInTree
+	}
+
+	var nodes []*TreeNode
+	t.walk(top, PreOrder, func(node *TreeNode) error {
+		nodes = append(nodes, node)
+		return nil
+	})
+
+	return NewTree(nodes), nil
+}
+
+// Walk visits every node, root by root, in the given order.
+// The callback may return SkipChildren or StopWalk; any other error ends the
+// walk and is returned.
+func (t *Tree) Walk(order WalkOrder, fn func(node *TreeNode) error) error {
+	for _, root := range t.Roots() {
+		if err := t.walk(root, order, fn); err != nil {
+			if errors.Is(err, StopWalk) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Tree) walk(node *TreeNode, order WalkOrder, fn func(node *TreeNode) error) error {
+	if order == PreOrder {
+		if err := fn(node); err != nil {
+			if errors.Is(err, SkipChildren) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range t.children[node.Path] {
+		if err := t.walk(child, order, fn); err != nil {
+			return err
+		}
+	}
+
+	if order == PostOrder {
+		if err := fn(node); err != nil && !errors.Is(err, SkipChildren) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check reports consistency problems: malformed paths, paths that don't end
+// with the node's code, orphans whose parent is missing below the top level,
+// ParentIDs that disagree with the path, and duplicates.
+func (t *Tree) Check() []TreeIssue {
+	issues := append([]TreeIssue(nil), t.issues...)
+
+	topDepth := -1
+	for _, node := range t.nodes {
+		if d := node.Path.Depth(); topDepth < 0 || d < topDepth {
+			topDepth = d
+		}
+	}
+
+	for _, node := range t.nodes {
+		if err := ValidatePath(string(node.Path)); err != nil {
+			issues = append(issues, TreeIssue{IssuePathMismatch, node, err.Error()})
+			continue
+		}
+
+		if node.Path.IsRoot() {
+			continue
+		}
+
+		if last, err := node.Path.GetLastNodeID(); err != nil || last != node.Code {
+			issues = append(issues, TreeIssue{IssuePathMismatch, node, "path does not end with code"})
+		}
+
+		parentPath, _ := node.Path.Parent()
+		parent := t.byPath[parentPath]
+		if parent == nil && node.Path.Depth() > topDepth {
+			issues = append(issues, TreeIssue{IssueOrphan, node, "parent " + string(parentPath) + " missing"})
+		}
+
+		expected := parentCodeOf(node.Path)
+		switch {
+		case node.ParentID == nil && expected != "":
+			issues = append(issues, TreeIssue{IssueParentMismatch, node, "parent_id is empty"})
+		case node.ParentID != nil && *node.ParentID != expected:
+			issues = append(issues, TreeIssue{IssueParentMismatch, node, "parent_id is " + string(*node.ParentID)})
+		}
+	}
+
+	return issues
+}
+
+// Add creates a node under parentPath in memory. The node is persisted as a
+// create by ApplyMutations.
+func (t *Tree) Add(name string, parentPath Path, owner OwnerFields) (*TreeNode, error) {
+	if !parentPath.IsRoot() && t.byPath[parentPath] == nil {
+		return nil, ErrNodeNotInTree
+	}
+
+	code := NewNodeID()
+	path, err := parentPath.AppendNode(code)
+	if err != nil {
+		return nil, err
+	}
+
+	var parentID *Code
+	if parentCode := parentCodeOf(path); parentCode != "" {
+		parentID = &parentCode
+	}
+
+	node := &TreeNode{
+		Code:     code,
+		Name:     name,
+		Path:     path,
+		ParentID: parentID,
+		Owner:    owner,
+	}
+	if parent := t.byPath[parentPath]; parent != nil {
+		node.Tenant = parent.Tenant
+	}
+
+	t.index(append(t.nodes, node))
+	return node, nil
+}
+
+// Move moves the node at nodePath and its descendants under newParentPath in memory
+func (t *Tree) Move(nodePath, newParentPath Path) error {
+	node := t.byPath[nodePath]
+	if node == nil || (!newParentPath.IsRoot() && t.byPath[newParentPath] == nil) {
+		return ErrNodeNotInTree
+	}
+
+	if nodePath == newParentPath || nodePath.Contains(newParentPath) {
+		return errors.New("cannot move a node to its own descendant")
+	}
+
+	newPath, err := newParentPath.AppendNode(node.Code)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range t.nodes {
+		if n == node || nodePath.Contains(n.Path) {
+			n.Path = Path(string(newPath) + string(n.Path)[len(nodePath):])
+		}
+	}
+
+	node.ParentID = nil
+	if parentCode := parentCodeOf(newPath); parentCode != "" {
+		node.ParentID = &parentCode
+	}
+
+	t.index(t.nodes)
+	return nil
+}
+
+// Remove deletes the node at nodePath and its descendants from memory.
+// The removal is persisted as a delete by ApplyMutations.
+func (t *Tree) Remove(nodePath Path) error {
+	if t.byPath[nodePath] == nil {
+		return ErrNodeNotInTree
+	}
+
+	remaining := make([]*TreeNode, 0, len(t.nodes))
+	for _, node := range t.nodes {
+		if node.Path != nodePath && !nodePath.Contains(node.Path) {
+			remaining = append(remaining, node)
+		}
+	}
+
+	t.index(remaining)
+	return nil
+}
+
+// MutationKind identifies the TreeQuery operation of a Mutation
+type MutationKind string
+
+const (
+	// MutationCreate is persisted with CreateNode
+	MutationCreate MutationKind = "create"
+
+	// MutationMove is persisted with MoveNode
+	MutationMove MutationKind = "move"
+
+	// MutationUpdate is persisted with UpdateNode
+	MutationUpdate MutationKind = "update"
+
+	// MutationDelete is persisted with DeleteNode, including descendants
+	MutationDelete MutationKind = "delete"
+)
+
+// Mutation is a single change needed to persist in-memory edits of a Tree.
+// Nodes are referenced by code because their paths change as mutations are applied.
+type Mutation struct {
+	Kind MutationKind
+
+	// Code is the node the mutation applies to. For creates it is the
+	// in-memory code, which the database replaces with a new one.
+	Code Code
+
+	// ParentCode is the new parent for creates and moves; empty means the root
+	ParentCode Code
+
+	// Name and Owner are set for creates
+	Name  string
+	Owner OwnerFields
+
+	// Updates holds the changed columns for updates, and the position for creates
+	Updates map[string]interface{}
+}
+
+// Diff returns the mutations that persist the in-memory edits made since the
+// tree was built. Creates come parent-first, moves are ordered so that no
+// intermediate state contains a cycle, and deletes come last so nodes moved
+// out of a removed branch are kept.
+func (t *Tree) Diff() []Mutation {
+	var creates, moves, updates, deletes []Mutation
+
+	for _, node := range t.nodes {
+		if node.Code == "" {
+			continue
+		}
+
+		before, existed := t.baseline[node.Code]
+		parentCode := parentCodeOf(node.Path)
+
+		if !existed {
+			create := Mutation{
+				Kind:       MutationCreate,
+				Code:       node.Code,
+				ParentCode: parentCode,
+				Name:       node.Name,
+				Owner:      node.Owner,
+			}
+			if node.Position != 0 {
+				create.Updates = map[string]interface{}{"position": node.Position}
+			}
+			creates = append(creates, create)
+			continue
+		}
+
+		if parentCode != before.parentCode {
+			moves = append(moves, Mutation{Kind: MutationMove, Code: node.Code, ParentCode: parentCode})
+		}
+
+		changes := make(map[string]interface{})
+		if node.Name != before.name {
+			changes["name"] = node.Name
+		}
+		if node.Position != before.position {
+			changes["position"] = node.Position
+		}
+		if node.Owner != before.owner {
+			changes["owner_id"] = node.Owner.ID
+			changes["owner_type"] = node.Owner.Type
+		}
+		if len(changes) > 0 {
+			updates = append(updates, Mutation{Kind: MutationUpdate, Code: node.Code, Updates: changes})
+		}
+	}
+
+	// Only the top-most removed node of a branch needs a delete
+	for code, before := range t.baseline {
+		if t.byCode[code] != nil {
+			continue
+		}
+		if _, parentExisted := t.baseline[before.parentCode]; parentExisted && t.byCode[before.parentCode] == nil {
+			continue
+		}
+		deletes = append(deletes, Mutation{Kind: MutationDelete, Code: code})
+	}
+	sort.Slice(deletes, func(i, j int) bool { return deletes[i].Code < deletes[j].Code })
+
+	byDepth := func(mutations []Mutation) {
+		sort.SliceStable(mutations, func(i, j int) bool {
+			return t.byCode[mutations[i].Code].Path.Depth() < t.byCode[mutations[j].Code].Path.Depth()
+		})
+	}
+	byDepth(creates)
+	byDepth(moves)
+
+	mutations := make([]Mutation, 0, len(creates)+len(moves)+len(updates)+len(deletes))
+	mutations = append(mutations, creates...)
+	mutations = append(mutations, moves...)
+	mutations = append(mutations, updates...)
+	return append(mutations, deletes...)
+}
+
+// ApplyMutations persists mutations produced by Tree.Diff in order, in a single
+// transaction: either all of them are applied or none. Nodes are looked up by
+// code before each step, so paths changed by earlier moves are honoured. It
+// returns the created nodes keyed by their in-memory codes.
+func (tq *TreeQuery) ApplyMutations(
+	mutations []Mutation,
+	tenantID,
+	tenantType string,
+) (map[Code]*TreeNode, error) {
+	var created map[Code]*TreeNode
+
+	err := tq.transaction(func(tq *TreeQuery) error {
+		created = make(map[Code]*TreeNode)
+		return tq.applyMutations(mutations, tenantID, tenantType, created)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+func (tq *TreeQuery) applyMutations(
+	mutations []Mutation,
+	tenantID,
+	tenantType string,
+	created map[Code]*TreeNode,
+) error {
+	// pathOf resolves the current path of a node, following codes replaced by creates
+	pathOf := func(code Code) (Path, error) {
+		if code == "" {
+			return RootPath, nil
+		}
+		if node, ok := created[code]; ok {
+			return node.Path, nil
+		}
+		node, err := tq.GetNodeByCode(code, tenantID, tenantType)
+		if err != nil {
+			return "", err
+		}
+		return node.Path, nil
+	}
+
+	for _, m := range mutations {
+		switch m.Kind {
+		case MutationCreate:
+			parentPath, err := pathOf(m.ParentCode)
+			if err != nil {
+				return err
+			}
+			node, err := tq.CreateNode(m.Name, parentPath, tenantID, tenantType, m.Owner.ID, m.Owner.Type)
+			if err != nil {
+				return err
+			}
+			created[m.Code] = node
+
+			if len(m.Updates) > 0 {
+				if err := tq.UpdateNode(node.Code, tenantID, tenantType, m.Updates); err != nil {
+					return err
+				}
+			}
+		case MutationMove:
+			nodePath, err := pathOf(m.Code)
+			if err != nil {
+				return err
+			}
+			parentPath, err := pathOf(m.ParentCode)
+			if err != nil {
+				return err
+			}
+			if err := tq.MoveNode(nodePath, parentPath, tenantID, tenantType); err != nil {
+				return err
+			}
+		case MutationUpdate:
+			if err := tq.UpdateNode(m.Code, tenantID, tenantType, m.Updates); err != nil {
+				return err
+			}
+		case MutationDelete:
+			nodePath, err := pathOf(m.Code)
+			if err != nil {
+				return err
+			}
+			if err := tq.DeleteNode(nodePath, tenantID, tenantType, true); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown mutation kind %q", m.Kind)
+		}
+	}
+
+	return nil
+}
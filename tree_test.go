@@ -0,0 +1,275 @@
+package materialized
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// outline describes nodes and their descendants in tree as name(children,...)
+func outline(tree *Tree, nodes []*TreeNode) string {
+	parts := make([]string, len(nodes))
+	for i, node := range nodes {
+		parts[i] = node.Name
+		if children := tree.Children(node.Path); len(children) > 0 {
+			parts[i] += "(" + outline(tree, children) + ")"
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// loadTree builds a Tree from every node of t1
+func loadTree(t *testing.T, tq *TreeQuery) *Tree {
+	t.Helper()
+
+	nodes, err := tq.GetDescendants(RootPath, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTree(nodes)
+}
+
+// treeFixture builds a(b(c),d), e and x(y) in t1, and a node in t2
+func treeFixture(t *testing.T, tq *TreeQuery) {
+	t.Helper()
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", a.Path, "t1", "org")
+	mustCreate(t, tq, "c", b.Path, "t1", "org")
+	mustCreate(t, tq, "d", a.Path, "t1", "org")
+	mustCreate(t, tq, "e", RootPath, "t1", "org")
+	x := mustCreate(t, tq, "x", RootPath, "t1", "org")
+	mustCreate(t, tq, "y", x.Path, "t1", "org")
+	mustCreate(t, tq, "other", RootPath, "t2", "org")
+}
+
+// byName returns the node of tree with the given name
+func byName(t *testing.T, tree *Tree, name string) *TreeNode {
+	t.Helper()
+
+	node := tree.Find(func(node *TreeNode) bool { return node.Name == name })
+	if node == nil {
+		t.Fatalf("no node %s", name)
+	}
+	return node
+}
+
+func TestTreeWalk(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	treeFixture(t, tq)
+	tree := loadTree(t, tq)
+
+	walk := func(order WalkOrder, fn func(node *TreeNode) error) (string, error) {
+		var visited []string
+		err := tree.Walk(order, func(node *TreeNode) error {
+			visited = append(visited, node.Name)
+			return fn(node)
+		})
+		return strings.Join(visited, ","), err
+	}
+	errStop := errors.New("stop")
+
+	tests := []struct {
+		name  string
+		order WalkOrder
+		fn    func(node *TreeNode) error
+		want  string
+		err   error
+	}{
+		{"pre-order", PreOrder, func(*TreeNode) error { return nil }, "a,b,c,d,e,x,y", nil},
+		{"post-order", PostOrder, func(*TreeNode) error { return nil }, "c,b,d,a,e,y,x", nil},
+		{"skip children", PreOrder, func(node *TreeNode) error {
+			if node.Name == "b" || node.Name == "x" {
+				return SkipChildren
+			}
+			return nil
+		}, "a,b,d,e,x", nil},
+		{"skip children in post-order", PostOrder, func(*TreeNode) error { return SkipChildren }, "c,b,d,a,e,y,x", nil},
+		{"stop", PreOrder, func(node *TreeNode) error {
+			if node.Name == "d" {
+				return StopWalk
+			}
+			return nil
+		}, "a,b,c,d", nil},
+		{"stop in post-order", PostOrder, func(node *TreeNode) error {
+			if node.Name == "a" {
+				return StopWalk
+			}
+			return nil
+		}, "c,b,d,a", nil},
+		{"error", PreOrder, func(node *TreeNode) error {
+			if node.Name == "c" {
+				return errStop
+			}
+			return nil
+		}, "a,b,c", errStop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := walk(tt.order, tt.fn)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Fatalf("visited %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTreeDiffApplyRoundTrip(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	treeFixture(t, tq)
+	tree := loadTree(t, tq)
+
+	if diff := tree.Diff(); len(diff) != 0 {
+		t.Fatalf("got %d mutations for an unchanged tree", len(diff))
+	}
+
+	// Rename and hand over b
+	b := byName(t, tree, "b")
+	b.Name = "b2"
+	b.Owner = OwnerFields{"someone", "user"}
+
+	// Move c out of b, then d under the moved c, so the moves depend on each other
+	if err := tree.Move(byName(t, tree, "c").Path, byName(t, tree, "e").Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Move(byName(t, tree, "d").Path, byName(t, tree, "c").Path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep y, delete the rest of its branch
+	if err := tree.Move(byName(t, tree, "y").Path, byName(t, tree, "a").Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Remove(byName(t, tree, "x").Path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create a branch under a moved node, then move its ancestor e under a
+	added, err := tree.Add("new", byName(t, tree, "d").Path, OwnerFields{"owner", "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer, err := tree.Add("newer", added.Path, OwnerFields{"owner", "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newer.Position = 3
+	if err := tree.Move(byName(t, tree, "e").Path, byName(t, tree, "a").Path); err != nil {
+		t.Fatal(err)
+	}
+
+	const want = "a(b2,e(c(d(new(newer)))),y)"
+	if got := outline(tree, tree.Roots()); got != want {
+		t.Fatalf("in memory: got %s, want %s", got, want)
+	}
+	if issues := tree.Check(); len(issues) != 0 {
+		t.Fatalf("in memory: got issues %v", issues)
+	}
+
+	mutations := tree.Diff()
+	kinds := map[MutationKind]int{}
+	for _, m := range mutations {
+		kinds[m.Kind]++
+	}
+	if kinds[MutationCreate] != 2 || kinds[MutationMove] != 4 || kinds[MutationUpdate] != 1 || kinds[MutationDelete] != 1 {
+		t.Fatalf("got mutations %v", kinds)
+	}
+
+	created, err := tq.ApplyMutations(mutations, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 || created[added.Code] == nil || created[newer.Code] == nil {
+		t.Fatalf("got %d created nodes, want new and newer", len(created))
+	}
+	if created[added.Code].Code == added.Code {
+		t.Fatal("the created node kept its in-memory code")
+	}
+
+	stored := loadTree(t, tq)
+	if got := outline(stored, stored.Roots()); got != want {
+		t.Fatalf("stored: got %s, want %s", got, want)
+	}
+	if issues := stored.Check(); len(issues) != 0 {
+		t.Fatalf("stored: got issues %v", issues)
+	}
+	if diff := stored.Diff(); len(diff) != 0 {
+		t.Fatalf("got %d mutations for the stored tree", len(diff))
+	}
+
+	if got := byName(t, stored, "b2").Owner; got != (OwnerFields{"someone", "user"}) {
+		t.Fatalf("b2 is owned by %+v", got)
+	}
+	if got := byName(t, stored, "newer").Position; got != 3 {
+		t.Fatalf("newer is at position %d, want 3", got)
+	}
+	if stored.Get(byName(t, tree, "y").Code) == nil {
+		t.Fatal("y was deleted with its former parent")
+	}
+
+	// The other tenant is untouched
+	others, err := tq.GetDescendants(RootPath, "t2", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(others); got != "other" {
+		t.Fatalf("t2 holds %s, want other", got)
+	}
+}
+
+func TestTreeDiffRemovesBranchOnce(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	treeFixture(t, tq)
+	tree := loadTree(t, tq)
+
+	if err := tree.Remove(byName(t, tree, "b").Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Remove(byName(t, tree, "x").Path); err != nil {
+		t.Fatal(err)
+	}
+
+	mutations := tree.Diff()
+	if len(mutations) != 2 || mutations[0].Kind != MutationDelete || mutations[1].Kind != MutationDelete {
+		t.Fatalf("got %+v, want a delete for b and x", mutations)
+	}
+
+	if _, err := tq.ApplyMutations(mutations, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+	stored := loadTree(t, tq)
+	if got := outline(stored, stored.Roots()); got != "a(d),e" {
+		t.Fatalf("stored: got %s, want a(d),e", got)
+	}
+}
+
+func TestApplyMutationsIsAtomic(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+	treeFixture(t, tq)
+	tree := loadTree(t, tq)
+
+	mutations := []Mutation{
+		{Kind: MutationUpdate, Code: byName(t, tree, "a").Code, Updates: map[string]interface{}{"name": "renamed"}},
+		{Kind: MutationMove, Code: byName(t, tree, "e").Code, ParentCode: byName(t, tree, "a").Code},
+		{Kind: MutationDelete, Code: NewNodeID()},
+	}
+	if _, err := tq.ApplyMutations(mutations, "t1", "org"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v for a missing node, want ErrUnauthorized", err)
+	}
+
+	stored := loadTree(t, tq)
+	if got := outline(stored, stored.Roots()); got != "a(b(c),d),e,x(y)" {
+		t.Fatalf("got %s after a failed apply, want the tree unchanged", got)
+	}
+
+	// Mutations of another tenant's nodes fail
+	if _, err := tq.ApplyMutations(mutations[:1], "t2", "org"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v from another tenant, want ErrUnauthorized", err)
+	}
+	if _, err := tq.ApplyMutations([]Mutation{{Kind: "rename"}}, "t1", "org"); err == nil {
+		t.Fatal("got no error for an unknown mutation kind")
+	}
+}
@@ -0,0 +1,131 @@
+package materialized
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrConflict is returned by the *IfVersion methods when the node was
+	// changed since the expected version was read
+	ErrConflict = errors.New("node was modified concurrently")
+
+	// ErrNotVersioned is returned by the *IfVersion methods when the table
+	// is not configured as Versioned
+	ErrNotVersioned = errors.New("table is not versioned")
+)
+
+// MigrateVersion adds the version column to the tree table of a Versioned
+// configuration. AutoMigrate leaves it out, so unversioned tables keep their schema.
+func (tq *TreeQuery) MigrateVersion() error {
+	if !tq.config.Versioned {
+		return ErrNotVersioned
+	}
+
+	db := CrossTenant(tq.db)
+	migrator := db.Migrator()
+	if migrator.HasColumn(&TreeNode{}, "version") {
+		return nil
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(&TreeNode{}); err != nil {
+		return err
+	}
+
+	return db.Exec("ALTER TABLE ? ADD ? ?",
+		clause.Table{Name: stmt.Schema.Table},
+		clause.Column{Name: "version"},
+		migrator.FullDataTypeOf(stmt.Schema.LookUpField("version")),
+	).Error
+}
+
+// bumpVersion adds the version increment to the column updates of a mutation
+func (tq *TreeQuery) bumpVersion(updates map[string]interface{}) {
+	if tq.config.Versioned {
+		updates["version"] = gorm.Expr("version + 1")
+	}
+}
+
+// UpdateNodeIfVersion updates a node's properties if its version is still
+// expectedVersion and returns the updated node. Otherwise it fails with
+// ErrConflict and returns the current node, e.g. to offer a merge.
+func (tq *TreeQuery) UpdateNodeIfVersion(
+	code Code,
+	tenantID,
+	tenantType string,
+	expectedVersion int64,
+	updates map[string]interface{},
+) (*TreeNode, error) {
+	if !tq.config.Versioned {
+		return nil, ErrNotVersioned
+	}
+
+	var node *TreeNode
+	err := tq.transaction(func(tq *TreeQuery) error {
+		before, err := tq.beforeUpdate(code, tenantID, tenantType)
+		if err != nil {
+			return err
+		}
+
+		query, err := tq.UpdateNodeQuery(tq.db, code, tenantID, tenantType, updates)
+		if err != nil {
+			return err
+		}
+
+		result := query.Where("version = ?", expectedVersion).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		node, err = tq.GetNodeByCode(code, tenantID, tenantType)
+		if err != nil {
+			return err
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrConflict
+		}
+
+		return tq.afterUpdate(code, tenantID, tenantType, before, node, updates)
+	})
+
+	return node, err
+}
+
+// MoveNodeIfVersion moves a node and its descendants to a new parent if the
+// node's version is still expectedVersion and returns the moved node. Otherwise
+// it fails with ErrConflict and returns the current node.
+func (tq *TreeQuery) MoveNodeIfVersion(
+	code Code,
+	newParentPath Path,
+	tenantID,
+	tenantType string,
+	expectedVersion int64,
+) (*TreeNode, error) {
+	if !tq.config.Versioned {
+		return nil, ErrNotVersioned
+	}
+
+	var node *TreeNode
+	err := tq.transaction(func(tq *TreeQuery) error {
+		current, err := tq.GetNodeByCode(code, tenantID, tenantType)
+		if err != nil {
+			return err
+		}
+
+		if err := tq.moveNode(current.Path, newParentPath, tenantID, tenantType, &expectedVersion); err != nil {
+			if errors.Is(err, ErrConflict) {
+				node, _ = tq.GetNodeByCode(code, tenantID, tenantType)
+			}
+			return err
+		}
+
+		node, err = tq.GetNodeByCode(code, tenantID, tenantType)
+		return err
+	})
+
+	return node, err
+}
@@ -0,0 +1,84 @@
+package materialized
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUnversionedTableHasNoVersionColumn(t *testing.T) {
+	tq := newTestTree(t, DefaultTableConfig())
+
+	if tq.db.Migrator().HasColumn(&TreeNode{}, "version") {
+		t.Fatal("unversioned table has a version column")
+	}
+
+	a := mustCreate(t, tq, "a", RootPath, "t1", "org")
+	b := mustCreate(t, tq, "b", RootPath, "t1", "org")
+	if err := tq.UpdateNode(a.Code, "t1", "org", map[string]interface{}{"name": "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.MoveNode(b.Path, a.Path, "t1", "org"); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := tq.GetNodeByCode(a.Code, "t1", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"version"`) {
+		t.Fatalf("unversioned node has a version in JSON: %s", data)
+	}
+
+	if _, err := tq.UpdateNodeIfVersion(a.Code, "t1", "org", 0, map[string]interface{}{"name": "x"}); !errors.Is(err, ErrNotVersioned) {
+		t.Fatalf("got %v, want ErrNotVersioned", err)
+	}
+}
+
+func TestVersionedTableMigratesAndChecksVersion(t *testing.T) {
+	db := newTestDB(t)
+
+	// An existing unversioned table gains the column once Versioned is set
+	unversioned, err := NewTreeQuery(db, DefaultTableConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unversioned.MigrateDefault(); err != nil {
+		t.Fatal(err)
+	}
+	a := mustCreate(t, unversioned, "a", RootPath, "t1", "org")
+
+	config := DefaultTableConfig()
+	config.Versioned = true
+	tq, err := NewTreeQuery(db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.MigrateDefault(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tq.MigrateDefault(); err != nil {
+		t.Fatalf("second migration: %v", err)
+	}
+	if !db.Migrator().HasColumn(&TreeNode{}, "version") {
+		t.Fatal("versioned table has no version column")
+	}
+
+	node, err := tq.UpdateNodeIfVersion(a.Code, "t1", "org", 0, map[string]interface{}{"name": "renamed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Version != 1 {
+		t.Fatalf("got version %d, want 1", node.Version)
+	}
+
+	node, err = tq.UpdateNodeIfVersion(a.Code, "t1", "org", 0, map[string]interface{}{"name": "stale"})
+	if !errors.Is(err, ErrConflict) || node == nil || node.Name != "renamed" {
+		t.Fatalf("got %+v, %v, want ErrConflict with the current node", node, err)
+	}
+}